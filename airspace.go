@@ -0,0 +1,508 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/golang/geo/s2"
+	"github.com/marni/goigc"
+)
+
+const (
+	feet         = 0.3048
+	nauticalMile = 1.852
+	// Degrees between the vertices of arcs and circles
+	arcStep = 5.0
+)
+
+// altitudeLimit is the floor or ceiling of an airspace, in meters above
+// the reference: MSL, AGL or FL (the standard pressure altitude)
+type altitudeLimit struct {
+	Meters    float64 `json:"meters"`
+	Reference string  `json:"reference"`
+	Unlimited bool    `json:"unlimited,omitempty"`
+	Text      string  `json:"text"`
+}
+
+// above returns how far the fix is above the limit, in meters
+func (l altitudeLimit) above(p igc.Point) float64 {
+	if l.Unlimited {
+		return math.Inf(-1)
+	}
+	if l.Reference == "FL" && p.PressureAltitude != 0 {
+		return float64(p.PressureAltitude) - l.Meters
+	}
+	if l.Reference == "AGL" {
+		elevation, _ := terrain.Elevation(p.LatLng)
+		return float64(altitude(p)) - elevation - l.Meters
+	}
+	return float64(altitude(p)) - l.Meters
+}
+
+// airspace is an airspace of an OpenAir file
+type airspace struct {
+	Name    string        `json:"name"`
+	Class   string        `json:"class"`
+	Floor   altitudeLimit `json:"floor"`
+	Ceiling altitudeLimit `json:"ceiling"`
+	Source  string        `json:"source"`
+	loop    *s2.Loop
+}
+
+// airspaceFile is an OpenAir file uploaded through the admin API
+type airspaceFile struct {
+	Name    string `bson:"name"`
+	Content string `bson:"content"`
+}
+
+// infringement is a span of fixes of a track inside an airspace. The
+// depths are the farthest the glider went inside, from the lateral
+// boundary and from the floor or ceiling, in meters.
+type infringement struct {
+	Airspace    string    `bson:"airspace" json:"airspace"`
+	Class       string    `bson:"class" json:"class"`
+	Start       time.Time `bson:"start" json:"start"`
+	End         time.Time `bson:"end" json:"end"`
+	MaxLateral  float64   `bson:"max_lateral" json:"max_lateral"`
+	MaxVertical float64   `bson:"max_vertical" json:"max_vertical"`
+}
+
+// Loaded airspaces, and the hash of the files they were read from
+var airspaces struct {
+	sync.RWMutex
+	list []airspace
+	hash string
+}
+
+var altitudePattern = regexp.MustCompile(`^(\d+(?:\.\d+)?)\s*(FT|F|M)?\s*(AMSL|MSL|AGL|AGND|ASFC|SFC|GND)?$`)
+
+// parseAltitude reads an OpenAir floor or ceiling, eg. FL65, 3500ft MSL,
+// 1000 ft AGL, 2000m, GND or UNL. Altitudes without reference are MSL, and
+// without unit in feet.
+func parseAltitude(s string) (altitudeLimit, error) {
+	text := strings.TrimSpace(s)
+	u := strings.ToUpper(text)
+	switch {
+	case u == "GND" || u == "SFC":
+		return altitudeLimit{Reference: "AGL", Text: text}, nil
+	case strings.HasPrefix(u, "UNL"):
+		return altitudeLimit{Reference: "MSL", Unlimited: true, Text: text}, nil
+	case strings.HasPrefix(u, "FL"):
+		fl, err := strconv.ParseFloat(strings.TrimSpace(u[2:]), 64)
+		if err != nil {
+			return altitudeLimit{}, fmt.Errorf("invalid altitude '%v'", text)
+		}
+		return altitudeLimit{Meters: fl * 100 * feet, Reference: "FL", Text: text}, nil
+	}
+	m := altitudePattern.FindStringSubmatch(u)
+	if m == nil {
+		return altitudeLimit{}, fmt.Errorf("invalid altitude '%v'", text)
+	}
+	value, _ := strconv.ParseFloat(m[1], 64)
+	if m[2] != "M" {
+		value *= feet
+	}
+	switch m[3] {
+	case "AGL", "AGND", "ASFC", "SFC", "GND":
+		return altitudeLimit{Meters: value, Reference: "AGL", Text: text}, nil
+	default:
+		return altitudeLimit{Meters: value, Reference: "MSL", Text: text}, nil
+	}
+}
+
+// parseDegrees reads an OpenAir angle, as dd:mm:ss, dd:mm.mmm or dd.ddd
+func parseDegrees(s string) (float64, error) {
+	var degrees float64
+	for i, part := range strings.Split(strings.TrimSpace(s), ":") {
+		v, err := strconv.ParseFloat(part, 64)
+		if err != nil || i > 2 {
+			return 0, fmt.Errorf("invalid coordinate '%v'", s)
+		}
+		degrees += v / math.Pow(60, float64(i))
+	}
+	return degrees, nil
+}
+
+// parseCoordinate reads an OpenAir coordinate, eg. 45:12:30 N 006:30:00 E
+func parseCoordinate(s string) (s2.LatLng, error) {
+	u := strings.ToUpper(s)
+	ns := strings.IndexAny(u, "NS")
+	ew := strings.IndexAny(u, "EW")
+	if ns < 0 || ew < ns {
+		return s2.LatLng{}, fmt.Errorf("invalid coordinate '%v'", s)
+	}
+	lat, err := parseDegrees(u[:ns])
+	if err != nil {
+		return s2.LatLng{}, err
+	}
+	lng, err := parseDegrees(u[ns+1 : ew])
+	if err != nil {
+		return s2.LatLng{}, err
+	}
+	if u[ns] == 'S' {
+		lat = -lat
+	}
+	if u[ew] == 'W' {
+		lng = -lng
+	}
+	return s2.LatLngFromDegrees(lat, lng), nil
+}
+
+// destination returns the location at distance km from the origin along
+// the initial bearing, in degrees clockwise from north
+func destination(origin s2.LatLng, bearing float64, distance float64) s2.LatLng {
+	return igc.FAISphere.Destination(origin, bearing, distance)
+}
+
+// bearing returns the initial bearing from a to b, in degrees clockwise from north
+func bearing(a s2.LatLng, b s2.LatLng) float64 {
+	return igc.FAISphere.Bearing(a, b)
+}
+
+// arc returns the vertices of an arc of the given radius in km around the
+// center, from one bearing to another, clockwise or counter-clockwise
+func arc(center s2.LatLng, radius float64, from float64, to float64, clockwise bool) []s2.LatLng {
+	sweep := math.Mod(to-from+360, 360)
+	if !clockwise {
+		sweep = -math.Mod(from-to+360, 360)
+	}
+	steps := int(math.Ceil(math.Abs(sweep) / arcStep))
+	if steps == 0 {
+		steps = 1
+	}
+	vertices := make([]s2.LatLng, 0, steps+1)
+	for i := 0; i <= steps; i++ {
+		vertices = append(vertices, destination(center, from+sweep*float64(i)/float64(steps), radius))
+	}
+	return vertices
+}
+
+// parseOpenAir reads the airspaces of an OpenAir file.
+//
+// Polygons (DP), arcs by angles (DA) or by end points (DB) around the
+// center and direction set by V, and circles (DC) are supported. Labels,
+// styles and airways are ignored.
+func parseOpenAir(r io.Reader, source string) ([]airspace, error) {
+	var result []airspace
+	var current *airspace
+	var vertices []s2.LatLng
+	var center s2.LatLng
+	clockwise := true
+
+	finish := func() error {
+		if current == nil {
+			return nil
+		}
+		var points []s2.Point
+		for _, v := range vertices {
+			p := s2.PointFromLatLng(v)
+			if len(points) == 0 || !points[len(points)-1].ApproxEqual(p) {
+				points = append(points, p)
+			}
+		}
+		if len(points) > 1 && points[0].ApproxEqual(points[len(points)-1]) {
+			points = points[:len(points)-1]
+		}
+		if len(points) < 3 {
+			return fmt.Errorf("airspace '%v' has less than three vertices", current.Name)
+		}
+		loop := s2.LoopFromPoints(points)
+		loop.Normalize()
+		if err := loop.Validate(); err != nil {
+			return fmt.Errorf("airspace '%v': %v", current.Name, err)
+		}
+		current.loop = loop
+		result = append(result, *current)
+		current, vertices, clockwise = nil, nil, true
+		return nil
+	}
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "*") {
+			continue
+		}
+		fields := strings.SplitN(text, " ", 2)
+		record, value := strings.ToUpper(fields[0]), ""
+		if len(fields) == 2 {
+			value = strings.TrimSpace(fields[1])
+		}
+		if i := strings.Index(value, "*"); i >= 0 {
+			value = strings.TrimSpace(value[:i])
+		}
+
+		if record != "AC" && current == nil {
+			continue
+		}
+		var err error
+		switch record {
+		case "AC":
+			if err = finish(); err != nil {
+				return nil, fmt.Errorf("line %v: %v", line, err)
+			}
+			current = &airspace{
+				Class:   value,
+				Floor:   altitudeLimit{Reference: "AGL", Text: "GND"},
+				Ceiling: altitudeLimit{Reference: "MSL", Unlimited: true, Text: "UNL"},
+				Source:  source,
+			}
+		case "AN":
+			current.Name = value
+		case "AL":
+			current.Floor, err = parseAltitude(value)
+		case "AH":
+			current.Ceiling, err = parseAltitude(value)
+		case "V":
+			kv := strings.SplitN(value, "=", 2)
+			if len(kv) != 2 {
+				err = fmt.Errorf("invalid variable '%v'", value)
+				break
+			}
+			switch strings.ToUpper(strings.TrimSpace(kv[0])) {
+			case "X":
+				center, err = parseCoordinate(kv[1])
+			case "D":
+				clockwise = strings.TrimSpace(kv[1]) != "-"
+			}
+		case "DP":
+			var v s2.LatLng
+			if v, err = parseCoordinate(value); err == nil {
+				vertices = append(vertices, v)
+			}
+		case "DA":
+			parts := strings.Split(value, ",")
+			if len(parts) != 3 {
+				err = fmt.Errorf("invalid arc '%v'", value)
+				break
+			}
+			var values [3]float64
+			for i, part := range parts {
+				if values[i], err = strconv.ParseFloat(strings.TrimSpace(part), 64); err != nil {
+					break
+				}
+			}
+			if err == nil {
+				vertices = append(vertices, arc(center, values[0]*nauticalMile, values[1], values[2], clockwise)...)
+			}
+		case "DB":
+			parts := strings.Split(value, ",")
+			if len(parts) != 2 {
+				err = fmt.Errorf("invalid arc '%v'", value)
+				break
+			}
+			var from, to s2.LatLng
+			if from, err = parseCoordinate(parts[0]); err != nil {
+				break
+			}
+			if to, err = parseCoordinate(parts[1]); err != nil {
+				break
+			}
+			radius := center.Distance(from).Radians() * igc.EarthRadius
+			vertices = append(vertices, arc(center, radius, bearing(center, from), bearing(center, to), clockwise)...)
+		case "DC":
+			var radius float64
+			if radius, err = strconv.ParseFloat(value, 64); err == nil {
+				for b := 0.0; b < 360; b += arcStep {
+					vertices = append(vertices, destination(center, b, radius*nauticalMile))
+				}
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %v: %v", line, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if err := finish(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// depth returns how far a fix is inside the airspace, from its lateral
+// boundary and from its floor or ceiling in meters, or false if it is out.
+//
+// Flight levels are compared to the pressure altitude, and other limits to
+// the GNSS altitude, over the terrain for AGL limits, or over sea level
+// where the terrain is unknown.
+func (a airspace) depth(p igc.Point) (float64, float64, bool) {
+	x := s2.PointFromLatLng(p.LatLng)
+	if !a.loop.RectBound().ContainsLatLng(p.LatLng) || !a.loop.ContainsPoint(x) {
+		return 0, 0, false
+	}
+	aboveFloor := a.Floor.above(p)
+	belowCeiling := -a.Ceiling.above(p)
+	if aboveFloor < 0 || belowCeiling < 0 {
+		return 0, 0, false
+	}
+
+	lateral := math.Inf(1)
+	vertices := a.loop.Vertices()
+	for i := range vertices {
+		d := s2.DistanceFromSegment(x, vertices[i], vertices[(i+1)%len(vertices)])
+		lateral = math.Min(lateral, d.Radians()*igc.EarthRadius*1000)
+	}
+	return lateral, math.Min(aboveFloor, belowCeiling), true
+}
+
+// checkAirspace returns the infringements of the track, one for every span
+// of consecutive fixes inside an airspace, in time order
+func checkAirspace(track igc.Track, spaces []airspace) []infringement {
+	result := []infringement{}
+	for _, a := range spaces {
+		var open *infringement
+		for _, p := range track.Points {
+			lateral, vertical, inside := a.depth(p)
+			if !inside {
+				if open != nil {
+					result = append(result, *open)
+					open = nil
+				}
+				continue
+			}
+			if open == nil {
+				open = &infringement{Airspace: a.Name, Class: a.Class, Start: p.Time}
+			}
+			open.End = p.Time
+			open.MaxLateral = math.Max(open.MaxLateral, lateral)
+			open.MaxVertical = math.Max(open.MaxVertical, vertical)
+		}
+		if open != nil {
+			result = append(result, *open)
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool { return result[i].Start.Before(result[j].Start) })
+	return result
+}
+
+// loadAirspaces reads the OpenAir files of dir, if any, and the files
+// uploaded through the admin API, replacing the loaded airspaces.
+func (db TrackDB) loadAirspaces(dir string) error {
+	var files []airspaceFile
+	if dir != "" {
+		paths, err := filepath.Glob(filepath.Join(dir, "*"))
+		if err != nil {
+			return err
+		}
+		for _, path := range paths {
+			if info, err := os.Stat(path); err != nil || info.IsDir() {
+				continue
+			}
+			content, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			files = append(files, airspaceFile{Name: filepath.Base(path), Content: string(content)})
+		}
+	}
+	var uploaded []airspaceFile
+	err := getNamedCollection(db, db.CollectionName+"Airspace").Find(nil).Sort("name").All(&uploaded)
+	if err != nil {
+		panic(err)
+	}
+	files = append(files, uploaded...)
+
+	var list []airspace
+	hash := sha1.New()
+	for _, file := range files {
+		spaces, err := parseOpenAir(strings.NewReader(file.Content), file.Name)
+		if err != nil {
+			return fmt.Errorf("%v: %v", file.Name, err)
+		}
+		list = append(list, spaces...)
+		fmt.Fprintf(hash, "%v\n%v\n", file.Name, file.Content)
+	}
+
+	airspaces.Lock()
+	airspaces.list, airspaces.hash = list, hex.EncodeToString(hash.Sum(nil))
+	airspaces.Unlock()
+	return nil
+}
+
+// SaveAirspaceFile stores an uploaded OpenAir file, replacing the file of
+// the same name, after checking it parses
+func (db TrackDB) SaveAirspaceFile(name string, content string) (int, error) {
+	spaces, err := parseOpenAir(strings.NewReader(content), name)
+	if err != nil {
+		return 0, err
+	}
+	_, err = getNamedCollection(db, db.CollectionName+"Airspace").Upsert(bson.M{"name": name}, airspaceFile{name, content})
+	if err != nil {
+		panic(err)
+	}
+	return len(spaces), nil
+}
+
+// checkInfringements returns the infringements of a track with the
+// loaded airspaces, and the hash of the airspace files they were checked with
+func checkInfringements(track igc.Track) ([]infringement, string) {
+	airspaces.RLock()
+	defer airspaces.RUnlock()
+	return checkAirspace(track, airspaces.list), airspaces.hash
+}
+
+// recheckInfringements checks the tracks last checked with other airspace
+// files again, reading them from their source. It runs in the background,
+// so errors are logged and the other tracks checked.
+func (db TrackDB) recheckInfringements() {
+	defer logPanic("airspace")
+	airspaces.RLock()
+	hash := airspaces.hash
+	airspaces.RUnlock()
+
+	var tracks []trackInfo
+	collection := getCollection(db)
+	defer collection.Database.Session.Close()
+	err := collection.Find(bson.M{"airspace_hash": bson.M{"$ne": hash}}).Select(bson.M{"id": 1, "track_src_url": 1}).All(&tracks)
+	if err != nil {
+		log.Println("airspace:", err)
+		return
+	}
+	for _, t := range tracks {
+		db.recheckTrack(t)
+	}
+}
+
+// recheckTrack checks a track against the current airspaces again
+func (db TrackDB) recheckTrack(t trackInfo) {
+	defer logPanic("airspace")
+	track, err := db.LoadTrack(t)
+	if err != nil {
+		log.Println("airspace:", t.ID, err)
+		return
+	}
+	infringements, checked := checkInfringements(track)
+	collection := getCollection(db)
+	defer collection.Database.Session.Close()
+	err = collection.Update(bson.M{"id": t.ID}, bson.M{"$set": bson.M{
+		"infringements": infringements,
+		"airspace_hash": checked,
+	}})
+	if err == mgo.ErrNotFound {
+		// deleted meanwhile
+		return
+	}
+	if err != nil {
+		log.Println("airspace:", t.ID, err)
+		return
+	}
+	db.publishTrack("updated", t.ID)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"math"
+	"time"
+
+	"github.com/marni/goigc"
+)
+
+const (
+	// Turnpoints allowed between start and finish in the contest score
+	contestTurnpoints = 3
+	// Fixes considered when optimizing the contest score, evenly spread over the flight
+	contestSamples = 300
+	// Fixes are taken as flying while the glider covers flightSpeed (km/h) or
+	// climbs or sinks flightVario (m/s) over the following flightWindow
+	flightWindow = 30 * time.Second
+	flightSpeed  = 15.0
+	flightVario  = 1.0
+)
+
+// altitude returns the GNSS altitude of a fix, or its pressure altitude if
+// the logger recorded no GNSS altitude
+func altitude(p igc.Point) int64 {
+	if p.GNSSAltitude != 0 {
+		return p.GNSSAltitude
+	}
+	return p.PressureAltitude
+}
+
+// maxClimb returns the largest height gain of the flight, from a low point
+// to any later high point, in meters
+func maxClimb(points []igc.Point) int64 {
+	if len(points) == 0 {
+		return 0
+	}
+	var best int64
+	low := altitude(points[0])
+	for _, p := range points[1:] {
+		alt := altitude(p)
+		if alt-low > best {
+			best = alt - low
+		}
+		if alt < low {
+			low = alt
+		}
+	}
+	return best
+}
+
+// contestScore returns the free distance score of the flight, in points.
+//
+// This is the free flight of online contests: the longest distance in km
+// from a start fix, through up to contestTurnpoints fixes in flight order,
+// to a finish fix, at one point per km.
+func contestScore(points []igc.Point) float64 {
+	score, _ := contestRoute(points)
+	return score
+}
+
+// contestRoute returns the contest score of the flight and the indices of
+// the start, turnpoint and finish fixes of its route.
+func contestRoute(points []igc.Point) (float64, []int) {
+	if len(points) < 2 {
+		return 0, nil
+	}
+	index := make([]int, len(points))
+	for i := range index {
+		index[i] = i
+	}
+	if len(points) > contestSamples {
+		index = make([]int, contestSamples)
+		for i := range index {
+			index[i] = i * (len(points) - 1) / (contestSamples - 1)
+		}
+	}
+
+	n := len(index)
+	dist := make([][]float64, n)
+	for i := range dist {
+		dist[i] = make([]float64, n)
+		for j := 0; j < i; j++ {
+			dist[i][j] = points[index[j]].Distance(points[index[i]])
+		}
+	}
+
+	// best[j] is the longest path ending at fix j with the legs flown so far,
+	// coming from the fix prev[leg][j]
+	best := make([]float64, n)
+	prev := make([][]int, contestTurnpoints+1)
+	score, lastLeg, finish := 0.0, 0, 0
+	for leg := 0; leg <= contestTurnpoints; leg++ {
+		next := make([]float64, n)
+		prev[leg] = make([]int, n)
+		for j := 1; j < n; j++ {
+			for i := 0; i < j; i++ {
+				if d := best[i] + dist[j][i]; d > next[j] {
+					next[j], prev[leg][j] = d, i
+				}
+			}
+			if next[j] > score {
+				score, lastLeg, finish = next[j], leg, j
+			}
+		}
+		best = next
+	}
+
+	route := []int{index[finish]}
+	for leg, j := lastLeg, finish; leg >= 0; leg-- {
+		j = prev[leg][j]
+		if index[j] != route[0] {
+			route = append([]int{index[j]}, route...)
+		}
+	}
+	return score, route
+}
+
+// detectFlight returns the indices of the takeoff and landing fixes, from
+// the ground speed and altitude change over a window after each fix, or
+// false if the glider never left the ground.
+//
+// The glider takes off within the first window it is flying over, and lands
+// within the last one, at the first and last fix moving at flight speed
+// from its neighbour, so the logger running on the ground is not counted.
+func detectFlight(points []igc.Point) (int, int, bool) {
+	first, last, end := -1, -1, -1
+	k := 0
+	for i := range points {
+		if k <= i {
+			k = i + 1
+		}
+		for k < len(points) && points[k].Time.Sub(points[i].Time) < flightWindow {
+			k++
+		}
+		if k == len(points) {
+			k = len(points) - 1
+		}
+		if flying(points[i], points[k]) {
+			if first < 0 {
+				first = i
+			}
+			last, end = i, k
+		}
+	}
+	if first < 0 {
+		return 0, 0, false
+	}
+
+	takeoff := first
+	for takeoff < end && !flying(points[takeoff], points[takeoff+1]) &&
+		points[takeoff+1].Time.Sub(points[first].Time) < flightWindow {
+		takeoff++
+	}
+	landing := end
+	for landing > last && !flying(points[landing-1], points[landing]) {
+		landing--
+	}
+	return takeoff, landing, true
+}
+
+// flying reports whether the glider moves at flight speed between two fixes
+func flying(a igc.Point, b igc.Point) bool {
+	dt := b.Time.Sub(a.Time).Seconds()
+	if dt <= 0 {
+		return false
+	}
+	speed := a.Distance(b) / dt * 3600
+	vario := math.Abs(float64(altitude(b)-altitude(a))) / dt
+	return speed >= flightSpeed || vario >= flightVario
+}
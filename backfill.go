@@ -0,0 +1,143 @@
+package main
+
+import (
+	"log"
+	"net"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// backfillTracks fills in what the tracks stored by earlier versions miss:
+// the given summary fields, the takeoff and launch site, and the geometry.
+//
+// Every track is read at most once. Tracks that can not be read for good,
+// eg. a source answering 404, are marked with backfill_error so that they
+// are not read again at every start, while those that failed for a network
+// or server error are tried again at the next start.
+func (db TrackDB) backfillTracks(fields ...string) {
+	defer logPanic("backfill")
+
+	var ids []int
+	geometry := getGeometryCollection(db)
+	defer geometry.Database.Session.Close()
+	if err := geometry.Find(nil).Distinct("id", &ids); err != nil {
+		log.Println("backfill:", err)
+		return
+	}
+	indexed := make(map[int]bool)
+	for _, id := range ids {
+		indexed[id] = true
+	}
+
+	missing := []bson.M{
+		{"site": bson.M{"$exists": false}},
+		{"site": 0, "takeoff_lat": bson.M{"$exists": false}},
+		{"id": bson.M{"$nin": ids}},
+	}
+	for _, f := range fields {
+		missing = append(missing, bson.M{f: bson.M{"$exists": false}})
+	}
+	collection := getCollection(db)
+	defer collection.Database.Session.Close()
+	var tracks []bson.Raw
+	err := collection.Find(bson.M{"$or": missing, "backfill_error": bson.M{"$exists": false}}).Sort("id").All(&tracks)
+	if err != nil {
+		log.Println("backfill:", err)
+		return
+	}
+	for _, raw := range tracks {
+		db.backfillTrack(raw, fields, indexed)
+	}
+}
+
+// backfillTrack fills in what a stored track misses, reading it only if
+// needed
+func (db TrackDB) backfillTrack(raw bson.Raw, fields []string, indexed map[int]bool) {
+	defer logPanic("backfill")
+	var stored bson.M
+	var t trackInfo
+	if err := raw.Unmarshal(&stored); err != nil {
+		panic(err)
+	}
+	if err := raw.Unmarshal(&t); err != nil {
+		panic(err)
+	}
+	has := func(field string) bool {
+		_, ok := stored[field]
+		return ok
+	}
+
+	set := bson.M{}
+	noTakeoff := !has("takeoff_lat")
+	needsSite := !has("site") || (t.Site == 0 && noTakeoff)
+	needsRead := noTakeoff && needsSite || !indexed[t.ID]
+	for _, f := range fields {
+		if !has(f) {
+			needsRead = true
+		}
+	}
+
+	if needsRead {
+		track, err := db.LoadTrack(t)
+		if err != nil {
+			log.Println("backfill:", t.ID, err)
+			if permanentLoadError(err) {
+				set["backfill_error"] = err.Error()
+				db.updateTrack(t.ID, set)
+			}
+			return
+		}
+		info := newTrackInfo(track)
+		summary, err := bson.Marshal(info)
+		if err != nil {
+			panic(err)
+		}
+		var values bson.M
+		if err := bson.Unmarshal(summary, &values); err != nil {
+			panic(err)
+		}
+		for _, f := range fields {
+			if !has(f) {
+				set[f] = values[f]
+			}
+		}
+		if noTakeoff && needsSite && len(track.Points) > 0 {
+			t.TakeoffLat, t.TakeoffLng = info.TakeoffLat, info.TakeoffLng
+			set["takeoff_lat"], set["takeoff_lng"], set["takeoff_time"] = info.TakeoffLat, info.TakeoffLng, info.TakeoffTime
+			set["landing_lat"], set["landing_lng"], set["landing_time"] = info.LandingLat, info.LandingLng, info.LandingTime
+		}
+		if !indexed[t.ID] {
+			db.SaveGeometry(newTrackGeometry(t.ID, track))
+		}
+	}
+	if needsSite {
+		set["site"] = 0
+		if t.TakeoffLat != 0 || t.TakeoffLng != 0 {
+			set["site"] = db.assignSite(t.TakeoffLat, t.TakeoffLng)
+		}
+	}
+	if len(set) > 0 {
+		db.updateTrack(t.ID, set)
+	}
+}
+
+// updateTrack sets fields of a stored track
+func (db TrackDB) updateTrack(id int, set bson.M) {
+	collection := getCollection(db)
+	defer collection.Database.Session.Close()
+	if err := collection.Update(bson.M{"id": id}, bson.M{"$set": set}); err != nil {
+		panic(err)
+	}
+}
+
+// permanentLoadError tells whether a track failed to be read for good, as
+// opposed to network and server errors worth trying again
+func permanentLoadError(err error) bool {
+	switch e := err.(type) {
+	case net.Error:
+		return false
+	case trackSourceError:
+		return e < 500
+	}
+	return true
+}
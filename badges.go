@@ -0,0 +1,330 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/golang/geo/s2"
+	"github.com/marni/goigc"
+)
+
+// FAI Sporting Code section 3 observation zones of badge courses, in m
+const (
+	badgeLineRadius      = 500 // half length of the start and finish lines
+	badgeTurnpointRadius = 500
+)
+
+// calibrationPoint is a line of the calibration certificate of a logger:
+// the pressure altitude it records at a true altitude, in m
+type calibrationPoint struct {
+	Indicated float64 `json:"indicated"`
+	True      float64 `json:"true"`
+}
+
+// calibration is the calibration table of a logger, by indicated altitude
+type calibration []calibrationPoint
+
+// altitude corrects a recorded pressure altitude, interpolating between the
+// points of the table and extrapolating from its first or last segment
+func (c calibration) altitude(indicated float64) float64 {
+	switch len(c) {
+	case 0:
+		return indicated
+	case 1:
+		return indicated + c[0].True - c[0].Indicated
+	}
+	i := sort.Search(len(c), func(i int) bool { return c[i].Indicated >= indicated })
+	if i == 0 {
+		i = 1
+	} else if i == len(c) {
+		i = len(c) - 1
+	}
+	a, b := c[i-1], c[i]
+	return a.True + (indicated-a.Indicated)*(b.True-a.True)/(b.Indicated-a.Indicated)
+}
+
+// validate sorts the table, checking that the indicated altitudes differ
+func (c calibration) validate() error {
+	sort.Slice(c, func(i, j int) bool { return c[i].Indicated < c[j].Indicated })
+	for i := 1; i < len(c); i++ {
+		if c[i].Indicated == c[i-1].Indicated {
+			return errors.New("duplicate indicated altitude in calibration")
+		}
+	}
+	return nil
+}
+
+// badgeFix is a fix given as evidence of a verdict
+type badgeFix struct {
+	Role             string    `json:"role"`
+	Time             time.Time `json:"time"`
+	Lat              float64   `json:"lat"`
+	Lng              float64   `json:"lng"`
+	PressureAltitude int64     `json:"pressure_altitude"` // as recorded
+	GNSSAltitude     int64     `json:"gnss_altitude"`
+	Altitude         float64   `json:"altitude"` // calibrated, m
+}
+
+// badgeVerdict tells whether a flight qualifies for a leg of a badge
+type badgeVerdict struct {
+	Badge     string     `json:"badge"` // silver, gold or diamond
+	Leg       string     `json:"leg"`   // distance, duration, gain or goal
+	Required  float64    `json:"required"`
+	Achieved  float64    `json:"achieved"`
+	Unit      string     `json:"unit"`
+	Qualifies bool       `json:"qualifies"`
+	Course    string     `json:"course,omitempty"` // straight or declared
+	Notes     []string   `json:"notes,omitempty"`
+	Evidence  []badgeFix `json:"evidence"`
+}
+
+// badgeReport is the check of a flight against every badge leg
+type badgeReport struct {
+	Track          int            `json:"track"`
+	Pilot          string         `json:"pilot"`
+	Glider         string         `json:"glider"`
+	GliderID       string         `json:"glider_id"`
+	Date           time.Time      `json:"date"`
+	Logger         string         `json:"logger"`
+	Signature      string         `json:"signature_status"`
+	AltitudeSource string         `json:"altitude_source"` // pressure or gnss
+	Calibrated     bool           `json:"calibrated"`
+	Declaration    *time.Time     `json:"declaration"`
+	DeclaredCourse []string       `json:"declared_course"`
+	CourseDistance float64        `json:"course_distance"` // km, WGS84
+	Verdicts       []badgeVerdict `json:"verdicts"`
+}
+
+// badgeRule is a leg of a badge, and what it requires
+type badgeRule struct {
+	Badge    string
+	Leg      string
+	Required float64
+}
+
+// badgeRules are the legs of the FAI gliding badges
+var badgeRules = []badgeRule{
+	{"silver", "distance", 50},
+	{"silver", "duration", 5},
+	{"silver", "gain", 1000},
+	{"gold", "distance", 300},
+	{"gold", "duration", 5},
+	{"gold", "gain", 3000},
+	{"diamond", "goal", 300},
+	{"diamond", "distance", 500},
+	{"diamond", "gain", 5000},
+}
+
+// badgeMeasure is the performance of a flight for a leg kind
+type badgeMeasure struct {
+	value    float64
+	loss     float64 // m, of the start above the finish of a distance
+	course   string
+	notes    []string
+	evidence []badgeFix
+}
+
+// badgeCourse returns the declared task of a track as a .cup task, with
+// the start and finish lines and turnpoint cylinders of the badges
+func badgeCourse(task igc.Task) cupTask {
+	course := cupTaskFromIGC(task).Tasks[0]
+	for i := range course.Zones {
+		switch i {
+		case 0:
+			course.Zones[i] = cupZone{Style: 2, R1: badgeLineRadius, A1: 90, Line: true}
+		case len(course.Zones) - 1:
+			course.Zones[i] = cupZone{Style: 3, R1: badgeLineRadius, A1: 90, Line: true}
+		default:
+			course.Zones[i] = cupZone{Style: 1, R1: badgeTurnpointRadius, A1: 180}
+		}
+	}
+	return course
+}
+
+// checkBadges checks a flight against every badge leg.
+//
+// Heights are the pressure altitudes corrected with the calibration of the
+// logger, or the GNSS altitudes if it recorded none. The flight starts at
+// the takeoff and ends at the landing. A straight distance goes from the
+// takeoff to the landing, and a declared course, declared before the
+// takeoff, from the crossing of its start line to the crossing of its
+// finish line through cylinders around its turnpoints. Where the start is
+// higher than the finish by more than 1% of the distance for the silver
+// badge, or by more than 1000 m for the gold and diamond badges, the
+// distance is reduced by 100 times the excess loss of height. Distances are
+// measured on the WGS84 ellipsoid.
+func checkBadges(info trackInfo, track igc.Track, cal calibration) badgeReport {
+	r := badgeReport{
+		Track:          info.ID,
+		Pilot:          track.Pilot,
+		Glider:         track.GliderType,
+		GliderID:       track.GliderID,
+		Date:           track.Date,
+		Logger:         track.Manufacturer + track.UniqueID,
+		Signature:      info.SignatureStatus,
+		AltitudeSource: "pressure",
+		Calibrated:     len(cal) > 0,
+		DeclaredCourse: []string{},
+		Verdicts:       []badgeVerdict{},
+	}
+	points := track.Points
+	if len(points) == 0 {
+		return r
+	}
+	pressure := false
+	for _, p := range points {
+		if p.PressureAltitude != 0 {
+			pressure = true
+			break
+		}
+	}
+	if !pressure {
+		r.AltitudeSource = "gnss"
+	}
+	height := func(p igc.Point) float64 {
+		if !pressure {
+			return float64(p.GNSSAltitude)
+		}
+		return cal.altitude(float64(p.PressureAltitude))
+	}
+	fix := func(role string, p igc.Point) badgeFix {
+		return badgeFix{
+			Role:             role,
+			Time:             p.Time,
+			Lat:              p.Lat.Degrees(),
+			Lng:              p.Lng.Degrees(),
+			PressureAltitude: p.PressureAltitude,
+			GNSSAltitude:     p.GNSSAltitude,
+			Altitude:         height(p),
+		}
+	}
+	// at returns the fix at a time
+	at := func(t time.Time) igc.Point {
+		i := sort.Search(len(points), func(i int) bool { return !points[i].Time.Before(t) })
+		if i == len(points) {
+			i--
+		}
+		return points[i]
+	}
+	// lossOfHeight returns a distance reduced for its loss of height, as
+	// allowed by the badge of the rule
+	lossOfHeight := func(m badgeMeasure, rule badgeRule) badgeMeasure {
+		allowed, note := 1000.0, "distance reduced for a loss of height over 1000 m"
+		if rule.Badge == "silver" {
+			allowed, note = m.value*10, "distance reduced for a loss of height over 1% of it"
+		}
+		if m.loss > allowed {
+			m.value = math.Max(0, m.value-(m.loss-allowed)/10)
+			m.notes = append(append([]string{}, m.notes...), note)
+		}
+		return m
+	}
+
+	takeoff, landing, flying := detectFlight(points)
+	if !flying {
+		takeoff, landing = 0, len(points)-1
+	}
+	flight := points[takeoff : landing+1]
+
+	measures := make(map[string]badgeMeasure)
+
+	duration := badgeMeasure{value: flight[len(flight)-1].Time.Sub(flight[0].Time).Hours()}
+	duration.evidence = []badgeFix{fix("takeoff", flight[0]), fix("landing", flight[len(flight)-1])}
+	measures["duration"] = duration
+
+	gain := badgeMeasure{}
+	low, bestLow, bestHigh := 0, 0, 0
+	for i, p := range flight {
+		if height(p) < height(flight[low]) {
+			low = i
+		}
+		if d := height(p) - height(flight[low]); d > gain.value {
+			gain.value, bestLow, bestHigh = d, low, i
+		}
+	}
+	gain.evidence = []badgeFix{fix("low point", flight[bestLow]), fix("high point", flight[bestHigh])}
+	measures["gain"] = gain
+
+	straight := badgeMeasure{course: "straight"}
+	straight.value = igc.WGS84.Distance(flight[0].LatLng, flight[len(flight)-1].LatLng)
+	straight.evidence = []badgeFix{fix("start", flight[0]), fix("finish", flight[len(flight)-1])}
+	straight.loss = height(flight[0]) - height(flight[len(flight)-1])
+
+	goal := badgeMeasure{course: "declared"}
+	if taskRoute(track) != nil {
+		declaration := track.Task.DeclarationDate
+		if !declaration.IsZero() {
+			r.Declaration = &declaration
+		}
+		course := badgeCourse(track.Task)
+		var route []s2.LatLng
+		for i := 1; i < len(course.Points)-1; i++ {
+			r.DeclaredCourse = append(r.DeclaredCourse, course.Points[i].Name)
+			route = append(route, course.latLng(i))
+		}
+		r.CourseDistance = igc.WGS84.RouteDistance(route)
+
+		v := verifyTask(track, course)
+		for i, p := range v.Points {
+			if p.Reached == nil {
+				goal.notes = append(goal.notes, "declared course not completed at "+p.Name)
+				break
+			}
+			role := "turnpoint " + p.Name
+			switch i {
+			case 0:
+				role = "start"
+			case len(v.Points) - 1:
+				role = "finish"
+			}
+			goal.evidence = append(goal.evidence, fix(role, at(*p.Reached)))
+		}
+		switch {
+		case declaration.IsZero() || !declaration.Before(flight[0].Time):
+			goal.notes = append(goal.notes, "course not declared before the takeoff")
+		case v.Completed:
+			goal.value = r.CourseDistance
+			goal.loss = height(at(*v.Points[0].Reached)) - height(at(*v.Points[len(v.Points)-1].Reached))
+		}
+	} else {
+		goal.notes = append(goal.notes, "no declared course")
+	}
+
+	units := map[string]string{"distance": "km", "goal": "km", "duration": "h", "gain": "m"}
+	for _, rule := range badgeRules {
+		m := measures[rule.Leg]
+		switch rule.Leg {
+		case "goal":
+			m = lossOfHeight(goal, rule)
+		case "distance":
+			// the longer of the straight and declared distances, each
+			// reduced by the rule of the badge
+			m = lossOfHeight(straight, rule)
+			if g := lossOfHeight(goal, rule); g.value > m.value {
+				m = g
+			}
+		}
+		v := badgeVerdict{
+			Badge:     rule.Badge,
+			Leg:       rule.Leg,
+			Required:  rule.Required,
+			Achieved:  m.value,
+			Unit:      units[rule.Leg],
+			Qualifies: m.value >= rule.Required,
+			Course:    m.course,
+			Notes:     m.notes,
+			Evidence:  m.evidence,
+		}
+		if v.Evidence == nil {
+			v.Evidence = []badgeFix{}
+		}
+		if rule.Leg == "gain" && r.AltitudeSource == "gnss" {
+			v.Qualifies = false
+			v.Notes = append(v.Notes, "no pressure altitude recorded")
+		}
+		r.Verdicts = append(r.Verdicts, v)
+	}
+	return r
+}
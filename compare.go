@@ -0,0 +1,282 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/globalsign/mgo/bson"
+	"github.com/golang/geo/s1"
+	"github.com/golang/geo/s2"
+	"github.com/marni/goigc"
+)
+
+const (
+	// Default seconds between the frames of a comparison
+	compareInterval = 10
+	// Most frames of a comparison, limiting the interval of long flights
+	compareMaxFrames = 10000
+	// Most tracks in a comparison
+	compareMaxTracks = 20
+	// Distance (km) a pilot must come within to reach a turnpoint of the route
+	turnpointRadius = 0.4
+)
+
+type comparePilot struct {
+	ID     int        `json:"id"`
+	Pilot  string     `json:"pilot"`
+	Glider string     `json:"glider"`
+	Start  time.Time  `json:"start"`
+	End    time.Time  `json:"end"`
+	Goal   *time.Time `json:"goal,omitempty"`
+}
+
+// comparePosition is the position of a pilot in a frame, and its deltas to
+// the leader of the frame: positive when the pilot is higher, and farther
+// from goal
+type comparePosition struct {
+	Lat            float64 `json:"lat"`
+	Lng            float64 `json:"lng"`
+	Altitude       float64 `json:"altitude"`
+	DistanceToGoal float64 `json:"distance_to_goal"`
+	AltitudeDelta  float64 `json:"altitude_delta"`
+	DistanceDelta  float64 `json:"distance_delta"`
+	Landed         bool    `json:"landed"`
+}
+
+// compareFrame holds the position of every pilot at a moment, in the order
+// of the pilots of the comparison: null before their track starts, and
+// their last fix once it has ended
+type compareFrame struct {
+	Time      time.Time          `json:"time"`
+	Leader    *int               `json:"leader"`
+	Positions []*comparePosition `json:"positions"`
+}
+
+type comparison struct {
+	Interval int            `json:"interval"`
+	Route    [][2]float64   `json:"route"`
+	Pilots   []comparePilot `json:"pilots"`
+	Frames   []compareFrame `json:"frames"`
+}
+
+// parseIDs reads a comma separated list of track ids
+func parseIDs(s string) ([]int, error) {
+	var ids []int
+	for _, part := range strings.Split(s, ",") {
+		id, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil {
+			return nil, fmt.Errorf("invalid id '%v'", part)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// taskRoute returns the start, turnpoints and finish of the declared task
+// of a track, or nil if it has none
+func taskRoute(track igc.Track) []s2.LatLng {
+	task := track.Task
+	if task.Start.LatLng == (s2.LatLng{}) && task.Finish.LatLng == (s2.LatLng{}) {
+		return nil
+	}
+	route := []s2.LatLng{task.Start.LatLng}
+	for _, tp := range task.Turnpoints {
+		route = append(route, tp.LatLng)
+	}
+	return append(route, task.Finish.LatLng)
+}
+
+// interpolate returns the position of the track at t, linearly
+// interpolated between the fixes around it, or the last fix after the end
+// of the track. It returns false before the track starts.
+func interpolate(points []igc.Point, t time.Time) (s2.LatLng, float64, bool) {
+	if len(points) == 0 || t.Before(points[0].Time) {
+		return s2.LatLng{}, 0, false
+	}
+	if last := points[len(points)-1]; !t.Before(last.Time) {
+		return last.LatLng, float64(altitude(last)), true
+	}
+	i := sort.Search(len(points), func(i int) bool { return !points[i].Time.Before(t) })
+	b := points[i]
+	if i == 0 || b.Time.Equal(t) {
+		return b.LatLng, float64(altitude(b)), true
+	}
+	a := points[i-1]
+	f := float64(t.Sub(a.Time)) / float64(b.Time.Sub(a.Time))
+	ll := s2.LatLng{
+		Lat: a.Lat + (b.Lat-a.Lat)*s1.Angle(f),
+		Lng: a.Lng + (b.Lng-a.Lng)*s1.Angle(f),
+	}
+	alt := float64(altitude(a)) + float64(altitude(b)-altitude(a))*f
+	return ll, alt, true
+}
+
+// racer follows the progress of a pilot along the route
+type racer struct {
+	next int       // index of the next turnpoint of the route to reach
+	goal time.Time // time the finish was reached
+}
+
+// advance moves the racer past the turnpoints reached at ll, and returns
+// its remaining distance to goal along the route, in km
+func (r *racer) advance(route []s2.LatLng, ll s2.LatLng, t time.Time) float64 {
+	for r.next < len(route) && ll.Distance(route[r.next]).Radians()*igc.EarthRadius <= turnpointRadius {
+		r.next++
+		if r.next == len(route) {
+			r.goal = t
+		}
+	}
+	if r.next == len(route) {
+		return 0
+	}
+	d := ll.Distance(route[r.next]).Radians() * igc.EarthRadius
+	for i := r.next + 1; i < len(route); i++ {
+		d += route[i-1].Distance(route[i]).Radians() * igc.EarthRadius
+	}
+	return d
+}
+
+// CompareTracks aligns the tracks on absolute time and samples their
+// positions every interval seconds, along with their progress on the route.
+//
+// The route is the declared task of the first track that has one, unless
+// a goal is given. The leader of a frame is the pilot closest to goal, or
+// the first one to reach it.
+func (db TrackDB) CompareTracks(ids []int, interval int, goal *s2.LatLng) (comparison, error) {
+	var infos []trackInfo
+	collection := getCollection(db)
+	defer collection.Database.Session.Close()
+	err := collection.Find(bson.M{"id": bson.M{"$in": ids}}).All(&infos)
+	if err != nil {
+		panic(err)
+	}
+	byID := make(map[int]trackInfo)
+	for _, info := range infos {
+		byID[info.ID] = info
+	}
+
+	result := comparison{Interval: interval, Route: [][2]float64{}, Frames: []compareFrame{}}
+	tracks := make([]igc.Track, len(ids))
+	var route []s2.LatLng
+	if goal != nil {
+		route = []s2.LatLng{*goal}
+	}
+	var start, end time.Time
+	for i, id := range ids {
+		info, ok := byID[id]
+		if !ok {
+			return result, fmt.Errorf("track %v not found", id)
+		}
+		tracks[i], err = db.LoadTrack(info)
+		if err != nil {
+			return result, fmt.Errorf("track %v: %v", id, err)
+		}
+		if route == nil {
+			route = taskRoute(tracks[i])
+		}
+
+		p := comparePilot{ID: id, Pilot: info.Pilot, Glider: info.Glider}
+		if points := tracks[i].Points; len(points) > 0 {
+			p.Start, p.End = points[0].Time, points[len(points)-1].Time
+			if start.IsZero() || p.Start.Before(start) {
+				start = p.Start
+			}
+			if p.End.After(end) {
+				end = p.End
+			}
+		}
+		result.Pilots = append(result.Pilots, p)
+	}
+	if route == nil {
+		return result, fmt.Errorf("no task declared, a goal is needed")
+	}
+	for _, ll := range route {
+		result.Route = append(result.Route, [2]float64{ll.Lat.Degrees(), ll.Lng.Degrees()})
+	}
+	if start.IsZero() {
+		return result, nil
+	}
+	step := time.Duration(interval) * time.Second
+	if int(end.Sub(start)/step) >= compareMaxFrames {
+		return result, fmt.Errorf("interval too small, more than %v frames", compareMaxFrames)
+	}
+
+	racers := make([]racer, len(tracks))
+	for t := start; !t.After(end); t = t.Add(step) {
+		frame := compareFrame{Time: t, Positions: make([]*comparePosition, len(tracks))}
+		leader := -1
+		for i := range tracks {
+			ll, alt, ok := interpolate(tracks[i].Points, t)
+			if !ok {
+				continue
+			}
+			frame.Positions[i] = &comparePosition{
+				Lat:            ll.Lat.Degrees(),
+				Lng:            ll.Lng.Degrees(),
+				Altitude:       alt,
+				DistanceToGoal: racers[i].advance(route, ll, t),
+				Landed:         t.After(result.Pilots[i].End),
+			}
+			if leader < 0 || ahead(racers[i], frame.Positions[i], racers[leader], frame.Positions[leader]) {
+				leader = i
+			}
+		}
+		if leader >= 0 {
+			frame.Leader = &result.Pilots[leader].ID
+			for _, p := range frame.Positions {
+				if p != nil {
+					p.AltitudeDelta = p.Altitude - frame.Positions[leader].Altitude
+					p.DistanceDelta = p.DistanceToGoal - frame.Positions[leader].DistanceToGoal
+				}
+			}
+		}
+		result.Frames = append(result.Frames, frame)
+	}
+	for i := range racers {
+		if !racers[i].goal.IsZero() {
+			result.Pilots[i].Goal = &racers[i].goal
+		}
+	}
+	return result, nil
+}
+
+// ahead reports whether pilot a leads pilot b: first in goal, then closest
+// to goal, then highest
+func ahead(ra racer, a *comparePosition, rb racer, b *comparePosition) bool {
+	if !ra.goal.IsZero() || !rb.goal.IsZero() {
+		return !ra.goal.IsZero() && (rb.goal.IsZero() || ra.goal.Before(rb.goal))
+	}
+	if a.DistanceToGoal != b.DistanceToGoal {
+		return a.DistanceToGoal < b.DistanceToGoal
+	}
+	return a.Altitude > b.Altitude
+}
+
+// parseComparison reads the ids, interval and goal of a comparison request
+func parseComparison(c *gin.Context) ([]int, int, *s2.LatLng, error) {
+	ids, err := parseIDs(c.Query("ids"))
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	if len(ids) < 2 || len(ids) > compareMaxTracks {
+		return nil, 0, nil, fmt.Errorf("between 2 and %v ids are needed", compareMaxTracks)
+	}
+	interval := compareInterval
+	if s := c.Query("interval"); s != "" {
+		if interval, err = strconv.Atoi(s); err != nil || interval < 1 {
+			return nil, 0, nil, fmt.Errorf("invalid interval")
+		}
+	}
+	if s := c.Query("goal"); s != "" {
+		goal, err := parseLatLng(s)
+		if err != nil {
+			return nil, 0, nil, err
+		}
+		return ids, interval, &goal, nil
+	}
+	return ids, interval, nil, nil
+}
@@ -0,0 +1,605 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/golang/geo/s2"
+	"github.com/marni/goigc"
+)
+
+// gapParams are the parameters of the GAP scoring of a competition
+type gapParams struct {
+	DayPoints       float64 `bson:"day_points" json:"day_points"`             // points of a day of full quality
+	NominalLaunch   float64 `bson:"nominal_launch" json:"nominal_launch"`     // fraction of the pilots expected to launch
+	NominalDistance float64 `bson:"nominal_distance" json:"nominal_distance"` // km
+	NominalTime     float64 `bson:"nominal_time" json:"nominal_time"`         // minutes, for the best time
+	NominalGoal     float64 `bson:"nominal_goal" json:"nominal_goal"`         // fraction of the pilots expected in goal
+	MinimumDistance float64 `bson:"minimum_distance" json:"minimum_distance"` // km, given to every pilot that launched
+	ArrivalPoints   bool    `bson:"arrival_points" json:"arrival_points"`
+	ESSNotGoal      float64 `bson:"ess_not_goal" json:"ess_not_goal"` // fraction of the time and arrival points kept without goal
+	EarthModel      string  `bson:"earth_model" json:"earth_model"`   // WGS84 or FAI_SPHERE, to measure distances on
+}
+
+// defaultGAPParams are the usual parameters of a paragliding competition
+var defaultGAPParams = gapParams{
+	DayPoints:       1000,
+	NominalLaunch:   0.96,
+	NominalDistance: 70,
+	NominalTime:     90,
+	NominalGoal:     0.3,
+	MinimumDistance: 5,
+	ArrivalPoints:   false,
+	ESSNotGoal:      0.8,
+	EarthModel:      "WGS84",
+}
+
+// compEntry is a track submitted by a pilot to a task
+type compEntry struct {
+	Track     int       `bson:"track" json:"track"`
+	Pilot     string    `bson:"pilot" json:"pilot"`
+	Submitted time.Time `bson:"submitted" json:"submitted"`
+}
+
+// compTask is a task of a competition day: the route of an igc.Task, from
+// the start to the finish, with the radius of every cylinder and the speed
+// section and goal options of XCTrack
+type compTask struct {
+	Number  int         `bson:"number" json:"number"`
+	Day     string      `bson:"day" json:"day"` // YYYY-MM-DD
+	Name    string      `bson:"name" json:"name"`
+	Route   igc.Task    `bson:"route" json:"-"`
+	Radii   []int       `bson:"radii" json:"radii"` // m, of the takeoff if any, the start, turnpoints and finish
+	ESS     int         `bson:"ess" json:"ess"`     // index of the ESS in Radii
+	SSS     xcStart     `bson:"sss" json:"sss"`
+	Goal    xcGoal      `bson:"goal" json:"goal"`
+	Present int         `bson:"present" json:"present"` // pilots at the takeoff, the entries if less
+	Entries []compEntry `bson:"entries" json:"entries"`
+}
+
+// competition is a set of tasks flown over one or more days
+type competition struct {
+	ID      int        `bson:"id" json:"id"`
+	Name    string     `bson:"name" json:"name"`
+	Created time.Time  `bson:"created" json:"created"`
+	Params  gapParams  `bson:"params" json:"params"`
+	Tasks   []compTask `bson:"tasks" json:"tasks"`
+}
+
+var (
+	errCompNotFound = errors.New("no such competition or task")
+	errTaskDay      = errors.New("track not flown on the day of the task")
+)
+
+func getCompetitionCollection(db TrackDB) *mgo.Collection {
+	return getNamedCollection(db, db.CollectionName+"Competitions")
+}
+
+// SaveCompetition stores a new competition, returning its id
+func (db TrackDB) SaveCompetition(name string, params gapParams) int {
+	collection := getCompetitionCollection(db)
+	defer collection.Database.Session.Close()
+	var last competition
+	id := 0
+	err := collection.Find(nil).Sort("-id").One(&last)
+	if err == nil {
+		id = last.ID + 1
+	} else if err != mgo.ErrNotFound {
+		panic(err)
+	}
+	err = collection.Insert(competition{ID: id, Name: name, Created: time.Now(), Params: params, Tasks: []compTask{}})
+	if err != nil {
+		panic(err)
+	}
+	return id
+}
+
+// GetCompetitions returns every competition, without its tasks
+func (db TrackDB) GetCompetitions() []competition {
+	comps := []competition{}
+	competitions := getCompetitionCollection(db)
+	defer competitions.Database.Session.Close()
+	err := competitions.Find(nil).Select(bson.M{"tasks": 0}).Sort("id").All(&comps)
+	if err != nil {
+		panic(err)
+	}
+	return comps
+}
+
+// LookupCompetition returns a competition by id
+func (db TrackDB) LookupCompetition(id int) (competition, bool) {
+	var c competition
+	competitions := getCompetitionCollection(db)
+	defer competitions.Database.Session.Close()
+	err := competitions.Find(bson.M{"id": id}).One(&c)
+	if err == mgo.ErrNotFound {
+		return c, false
+	}
+	if err != nil {
+		panic(err)
+	}
+	return c, true
+}
+
+// AddCompetitionTask adds a task to a competition, returning its number
+func (db TrackDB) AddCompetitionTask(id int, task compTask) int {
+	task.Entries = []compEntry{}
+	competitions := getCompetitionCollection(db)
+	defer competitions.Database.Session.Close()
+	for {
+		c, ok := db.LookupCompetition(id)
+		if !ok {
+			return -1
+		}
+		// only pushed if no other task was added meanwhile, the number
+		// being taken again otherwise
+		task.Number = len(c.Tasks) + 1
+		err := competitions.Update(
+			bson.M{"id": id, "tasks": bson.M{"$size": len(c.Tasks)}},
+			bson.M{"$push": bson.M{"tasks": task}})
+		if err == mgo.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			panic(err)
+		}
+		return task.Number
+	}
+}
+
+// SubmitEntry enters a track in a task, replacing the earlier entry of the
+// same pilot
+func (db TrackDB) SubmitEntry(id int, number int, info trackInfo) error {
+	c, ok := db.LookupCompetition(id)
+	if !ok || number < 1 || number > len(c.Tasks) {
+		return errCompNotFound
+	}
+	if info.FlightDate.Format("2006-01-02") != c.Tasks[number-1].Day {
+		return errTaskDay
+	}
+	collection := getCompetitionCollection(db)
+	defer collection.Database.Session.Close()
+	key := fmt.Sprintf("tasks.%d.entries", number-1)
+	entry := compEntry{Track: info.ID, Pilot: info.Pilot, Submitted: time.Now()}
+	for {
+		err := collection.Update(bson.M{"id": id}, bson.M{"$pull": bson.M{key: bson.M{"pilot": info.Pilot}}})
+		if err == mgo.ErrNotFound {
+			return errCompNotFound
+		}
+		if err != nil {
+			panic(err)
+		}
+		// only pushed if the pilot has not entered again meanwhile, the
+		// entry then being replaced again
+		err = collection.Update(
+			bson.M{"id": id, key + ".pilot": bson.M{"$ne": info.Pilot}},
+			bson.M{"$push": bson.M{key: entry}})
+		if err == mgo.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			panic(err)
+		}
+		return nil
+	}
+}
+
+// lookupCompetitionTask returns the competition and the number of the task
+// of the id and task parameters of a request, or false if there is none
+func (db TrackDB) lookupCompetitionTask(c *gin.Context) (competition, int, bool) {
+	id, err := getAndValidateID(c)
+	if err != nil {
+		return competition{}, 0, false
+	}
+	comp, ok := db.LookupCompetition(id)
+	if !ok {
+		return comp, 0, false
+	}
+	number, err := strconv.Atoi(c.Param("task"))
+	if err != nil || number < 1 || number > len(comp.Tasks) {
+		return comp, 0, false
+	}
+	return comp, number, true
+}
+
+// compTaskFromXC returns the competition task of an XCTrack task, whose
+// speed section must start at the first turnpoint after the takeoff
+func compTaskFromXC(x xcTask) (compTask, error) {
+	var t compTask
+	tps := x.Turnpoints
+	point := func(tp xcTurnpoint) igc.Point {
+		p := igc.NewPointFromLatLng(tp.Waypoint.Lat, tp.Waypoint.Lon)
+		p.Description = tp.Waypoint.Name
+		p.GNSSAltitude = int64(tp.Waypoint.AltSmoothed)
+		return p
+	}
+	if tps[0].Type == "TAKEOFF" {
+		t.Route.Takeoff = point(tps[0])
+		t.Radii = append(t.Radii, tps[0].Radius)
+	}
+	first := x.first()
+	if x.indexOf("SSS", first) != first {
+		return t, errors.New("the speed section must start at the first turnpoint")
+	}
+	if len(tps)-first < 2 {
+		return t, errors.New("a competition task needs a start and a finish")
+	}
+	t.Route.Start = point(tps[first])
+	for _, tp := range tps[first+1 : len(tps)-1] {
+		t.Route.Turnpoints = append(t.Route.Turnpoints, point(tp))
+	}
+	t.Route.Finish = point(tps[len(tps)-1])
+	for _, tp := range tps[first:] {
+		t.Radii = append(t.Radii, tp.Radius)
+	}
+	t.ESS = x.indexOf("ESS", len(tps)-1)
+	t.SSS = xcStart{Type: "RACE", Direction: "EXIT"}
+	if x.SSS != nil {
+		t.SSS = *x.SSS
+	}
+	t.Goal = xcGoal{Type: "CYLINDER"}
+	if x.Goal != nil {
+		t.Goal = *x.Goal
+	}
+	return t, nil
+}
+
+// xc returns the task as an XCTrack task
+func (t compTask) xc() xcTask {
+	x := xcTask{TaskType: "CLASSIC", Version: 1, EarthModel: "WGS84"}
+	var points []igc.Point
+	if t.Route.Takeoff.LatLng != (s2.LatLng{}) {
+		points = append(points, t.Route.Takeoff)
+	}
+	start := len(points)
+	points = append(points, t.Route.Start)
+	points = append(points, t.Route.Turnpoints...)
+	points = append(points, t.Route.Finish)
+	for i, p := range points {
+		tp := xcTurnpoint{
+			Radius: t.Radii[i],
+			Waypoint: xcWaypoint{
+				Name:        p.Description,
+				Lat:         p.Lat.Degrees(),
+				Lon:         p.Lng.Degrees(),
+				AltSmoothed: int(p.GNSSAltitude),
+			},
+		}
+		switch i {
+		case start - 1:
+			tp.Type = "TAKEOFF"
+		case start:
+			tp.Type = "SSS"
+		case t.ESS:
+			tp.Type = "ESS"
+		}
+		x.Turnpoints = append(x.Turnpoints, tp)
+	}
+	sss, goal := t.SSS, t.Goal
+	x.SSS, x.Goal = &sss, &goal
+	return x
+}
+
+// compResult is the score of a pilot on a task
+type compResult struct {
+	Rank               int        `json:"rank"`
+	Pilot              string     `json:"pilot"`
+	Track              int        `json:"track"`
+	Distance           float64    `json:"distance"` // km made along the optimized route
+	Start              *time.Time `json:"start"`
+	ESS                *time.Time `json:"ess"`
+	Goal               bool       `json:"goal"`
+	SpeedTime          float64    `json:"speed_time"` // seconds
+	Arrival            int        `json:"arrival"`    // order of arrival at the ESS
+	LeadingCoefficient float64    `json:"leading_coefficient"`
+	DistancePoints     float64    `json:"distance_points"`
+	TimePoints         float64    `json:"time_points"`
+	LeadingPoints      float64    `json:"leading_points"`
+	ArrivalPoints      float64    `json:"arrival_points"`
+	Total              float64    `json:"total"`
+}
+
+// compTaskResult is the result of a task, with the validities of the day
+type compTaskResult struct {
+	Task             int          `json:"task"`
+	Day              string       `json:"day"`
+	Name             string       `json:"name"`
+	TaskDistance     float64      `json:"task_distance"`          // km, optimized
+	SpeedSection     float64      `json:"speed_section_distance"` // km, optimized
+	Present          int          `json:"present"`
+	Flying           int          `json:"flying"`
+	InGoal           int          `json:"in_goal"`
+	LaunchValidity   float64      `json:"launch_validity"`
+	DistanceValidity float64      `json:"distance_validity"`
+	TimeValidity     float64      `json:"time_validity"`
+	DayQuality       float64      `json:"day_quality"`
+	AvailablePoints  float64      `json:"available_points"`
+	DistanceWeight   float64      `json:"distance_weight"`
+	TimeWeight       float64      `json:"time_weight"`
+	LeadingWeight    float64      `json:"leading_weight"`
+	ArrivalWeight    float64      `json:"arrival_weight"`
+	Results          []compResult `json:"results"`
+}
+
+// compFlight is a track followed through a task
+type compFlight struct {
+	result compResult
+	score  taskScore
+	track  igc.Track
+	remain float64 // km left to goal at the best point
+}
+
+// ScoreTask computes the GAP result of a task from the tracks of its
+// entries, in the order of the entries.
+//
+// Distances are measured on the earth model of the parameters, WGS84 by
+// default. The task and speed section distances follow the optimized route
+// through the cylinders. The distance made is what is left of the task at the
+// best point of the flight, towards the next turnpoint then along the
+// optimized route. The leading coefficient sums, over the speed section,
+// the time since the first start at which every bit of the remaining
+// distance to the ESS was covered, weighted by that distance.
+func (p gapParams) ScoreTask(task compTask, tracks []igc.Track) compTaskResult {
+	x := task.xc()
+	if p.EarthModel != "" {
+		x.EarthModel = p.EarthModel
+	}
+	first := x.first()
+	route := x.optimizedRoute()
+	n := len(route)
+	ess := task.ESS - first
+	km := x.model().Distance
+	// toGoal[i] and toESS[i] are the distances from route[i] on
+	toGoal := make([]float64, n)
+	toESS := make([]float64, n)
+	for i := n - 2; i >= 0; i-- {
+		toGoal[i] = toGoal[i+1] + km(route[i], route[i+1])
+		if i < ess {
+			toESS[i] = toESS[i+1] + km(route[i], route[i+1])
+		}
+	}
+
+	r := compTaskResult{
+		Task:         task.Number,
+		Day:          task.Day,
+		Name:         task.Name,
+		TaskDistance: toGoal[0],
+		SpeedSection: toESS[0],
+		Present:      task.Present,
+	}
+
+	var flights []*compFlight
+	var t0, tEnd time.Time
+	for i, track := range tracks {
+		e := task.Entries[i]
+		if len(track.Points) == 0 {
+			continue
+		}
+		f := &compFlight{score: x.ScoreTrack(track), track: track, remain: r.TaskDistance}
+		f.result = compResult{Pilot: e.Pilot, Track: e.Track, Start: f.score.Start, ESS: f.score.ESS, Goal: f.score.Goal, SpeedTime: f.score.SpeedTime}
+		flights = append(flights, f)
+		if f.score.Start != nil && (t0.IsZero() || f.score.Start.Before(t0)) {
+			t0 = *f.score.Start
+		}
+		if last := track.Points[len(track.Points)-1].Time; last.After(tEnd) {
+			tEnd = last
+		}
+	}
+	r.Flying = len(flights)
+	if r.Present < r.Flying {
+		r.Present = r.Flying
+	}
+
+	// next returns the index in the route of the turnpoint to reach at a time
+	next := func(s taskScore, t time.Time) int {
+		i := 0
+		for i < n && s.Turnpoints[i].Reached != nil && !s.Turnpoints[i].Reached.After(t) {
+			i++
+		}
+		return i
+	}
+	bestDistance, bestTime := 0.0, 0.0
+	for _, f := range flights {
+		s := f.score
+		var crossing *time.Time
+		if s.Start != nil {
+			crossing = s.Turnpoints[0].Reached
+		}
+		best := toESS[0]
+		lc := 0.0
+		for _, pt := range f.track.Points {
+			k := next(s, pt.Time)
+			if k < n {
+				f.remain = math.Min(f.remain, km(pt.LatLng, route[k])+toGoal[k])
+			}
+			if crossing == nil || pt.Time.Before(*crossing) || k > ess {
+				continue
+			}
+			if d := km(pt.LatLng, route[k]) + toESS[k]; d < best {
+				lc += pt.Time.Sub(t0).Seconds() * (best*best - d*d)
+				best = d
+			}
+		}
+		if s.Goal {
+			f.remain = 0
+		}
+		if s.ESS != nil {
+			lc += s.ESS.Sub(t0).Seconds() * best * best
+		} else if crossing != nil {
+			lc += tEnd.Sub(t0).Seconds() * best * best
+		}
+		if crossing != nil && r.SpeedSection > 0 {
+			f.result.LeadingCoefficient = lc / (1800 * r.SpeedSection * r.SpeedSection)
+		}
+		f.result.Distance = math.Max(0, r.TaskDistance-f.remain)
+		bestDistance = math.Max(bestDistance, f.result.Distance)
+		if s.Goal {
+			r.InGoal++
+			if bestTime == 0 || s.SpeedTime < bestTime {
+				bestTime = s.SpeedTime
+			}
+		}
+	}
+	if r.Flying == 0 {
+		r.Results = []compResult{}
+		return r
+	}
+
+	// validities of the day
+	lvr := math.Min(1, float64(r.Flying)/(float64(r.Present)*p.NominalLaunch))
+	r.LaunchValidity = math.Min(1, 0.027*lvr+2.917*lvr*lvr-1.944*lvr*lvr*lvr)
+	sumOver := 0.0
+	for _, f := range flights {
+		sumOver += math.Max(0, f.result.Distance-p.MinimumDistance)
+	}
+	area := ((p.NominalGoal+1)*(p.NominalDistance-p.MinimumDistance) + p.NominalGoal*math.Max(0, bestDistance-p.NominalDistance)) / 2
+	if area > 0 {
+		r.DistanceValidity = math.Min(1, sumOver/(float64(r.Flying)*area))
+	}
+	ratio := bestDistance / p.NominalDistance
+	if r.InGoal > 0 {
+		ratio = bestTime / 60 / p.NominalTime
+	}
+	r.TimeValidity = math.Max(0, math.Min(1, -0.271+2.912*ratio-2.098*ratio*ratio+0.457*ratio*ratio*ratio))
+	r.DayQuality = r.LaunchValidity * r.DistanceValidity * r.TimeValidity
+	r.AvailablePoints = p.DayPoints * r.DayQuality
+
+	// weights of the points
+	gr := float64(r.InGoal) / float64(r.Flying)
+	r.DistanceWeight = 0.9 - 1.665*gr + 1.713*gr*gr - 0.587*gr*gr*gr
+	if gr == 0 {
+		if r.TaskDistance > 0 {
+			r.LeadingWeight = bestDistance / r.TaskDistance * 0.1
+		}
+	} else {
+		r.LeadingWeight = (1 - r.DistanceWeight) / 8 * 1.4
+		if p.ArrivalPoints {
+			r.ArrivalWeight = (1 - r.DistanceWeight) / 8
+		}
+	}
+	r.TimeWeight = 1 - r.DistanceWeight - r.LeadingWeight - r.ArrivalWeight
+
+	// arrival order and best times
+	var arrived []*compFlight
+	minLC, minTime := 0.0, 0.0
+	for _, f := range flights {
+		if f.score.ESS != nil {
+			arrived = append(arrived, f)
+			if minTime == 0 || f.result.SpeedTime < minTime {
+				minTime = f.result.SpeedTime
+			}
+		}
+		if f.result.Start != nil && (minLC == 0 || f.result.LeadingCoefficient < minLC) {
+			minLC = f.result.LeadingCoefficient
+		}
+	}
+	sort.SliceStable(arrived, func(i, j int) bool { return arrived[i].score.ESS.Before(*arrived[j].score.ESS) })
+	for i, f := range arrived {
+		f.result.Arrival = i + 1
+	}
+
+	for _, f := range flights {
+		res := &f.result
+		if bestDistance > 0 {
+			res.DistancePoints = r.AvailablePoints * r.DistanceWeight * math.Min(1, math.Max(res.Distance, p.MinimumDistance)/bestDistance)
+		}
+		factor := 1.0
+		if !res.Goal {
+			factor = p.ESSNotGoal
+		}
+		if res.ESS != nil && minTime > 0 {
+			sf := 1 - math.Pow((res.SpeedTime-minTime)/3600/math.Sqrt(minTime/3600), 5.0/6)
+			res.TimePoints = r.AvailablePoints * r.TimeWeight * math.Max(0, sf) * factor
+			ac := 1 - float64(res.Arrival-1)/float64(len(arrived))
+			af := 0.2 + 0.037*ac + 0.13*ac*ac + 0.633*ac*ac*ac
+			res.ArrivalPoints = r.AvailablePoints * r.ArrivalWeight * af * factor
+		}
+		if res.Start != nil {
+			lf := 1.0
+			if minLC > 0 {
+				lf = 1 - math.Pow((res.LeadingCoefficient-minLC)/math.Sqrt(minLC), 2.0/3)
+			}
+			res.LeadingPoints = r.AvailablePoints * r.LeadingWeight * math.Max(0, lf)
+		}
+		res.Total = math.Round(res.DistancePoints + res.TimePoints + res.LeadingPoints + res.ArrivalPoints)
+		r.Results = append(r.Results, *res)
+	}
+	sort.SliceStable(r.Results, func(i, j int) bool {
+		if r.Results[i].Total != r.Results[j].Total {
+			return r.Results[i].Total > r.Results[j].Total
+		}
+		return r.Results[i].Distance > r.Results[j].Distance
+	})
+	for i := range r.Results {
+		r.Results[i].Rank = i + 1
+		if i > 0 && r.Results[i].Total == r.Results[i-1].Total {
+			r.Results[i].Rank = r.Results[i-1].Rank
+		}
+	}
+	return r
+}
+
+// TaskResult scores a task of a competition, loading the tracks entered
+func (db TrackDB) TaskResult(c competition, number int) (compTaskResult, error) {
+	task := c.Tasks[number-1]
+	tracks := make([]igc.Track, len(task.Entries))
+	for i, e := range task.Entries {
+		info, ok := db.LookupTrack(e.Track)
+		if !ok {
+			continue
+		}
+		track, err := db.LoadTrack(info)
+		if err != nil {
+			return compTaskResult{}, err
+		}
+		tracks[i] = track
+	}
+	return c.Params.ScoreTask(task, tracks), nil
+}
+
+// compStanding is the overall result of a pilot
+type compStanding struct {
+	Rank  int                `json:"rank"`
+	Pilot string             `json:"pilot"`
+	Total float64            `json:"total"`
+	Days  map[string]float64 `json:"days"`  // points by day
+	Tasks map[int]float64    `json:"tasks"` // points by task number
+}
+
+// overallResults sums the points of every pilot over the task results
+func overallResults(results []compTaskResult) []compStanding {
+	byPilot := make(map[string]*compStanding)
+	standings := []compStanding{}
+	var order []string
+	for _, r := range results {
+		for _, res := range r.Results {
+			s, ok := byPilot[res.Pilot]
+			if !ok {
+				s = &compStanding{Pilot: res.Pilot, Days: make(map[string]float64), Tasks: make(map[int]float64)}
+				byPilot[res.Pilot] = s
+				order = append(order, res.Pilot)
+			}
+			s.Total += res.Total
+			s.Days[r.Day] += res.Total
+			s.Tasks[r.Task] = res.Total
+		}
+	}
+	for _, pilot := range order {
+		standings = append(standings, *byPilot[pilot])
+	}
+	sort.SliceStable(standings, func(i, j int) bool { return standings[i].Total > standings[j].Total })
+	for i := range standings {
+		standings[i].Rank = i + 1
+		if i > 0 && standings[i].Total == standings[i-1].Total {
+			standings[i].Rank = standings[i-1].Rank
+		}
+	}
+	return standings
+}
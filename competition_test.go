@@ -0,0 +1,193 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/marni/goigc"
+)
+
+// gapTestTrack returns a track through the given fixes, one per time of day
+// in minutes after noon, all on the equator
+func gapTestTrack(pilot string, fixes map[int]float64) igc.Track {
+	track := igc.NewTrack()
+	track.Pilot = pilot
+	noon := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+	for minute := 0; minute <= 70; minute++ {
+		lng, ok := fixes[minute]
+		if !ok {
+			continue
+		}
+		p := igc.NewPointFromLatLng(0, lng)
+		p.Time = noon.Add(time.Duration(minute) * time.Minute)
+		track.Points = append(track.Points, p)
+	}
+	return track
+}
+
+// TestScoreTask scores a race along the equator, with cylinders of 1 km at
+// 0°, 0.5° (the ESS) and 1° of longitude, on the FAI sphere, where a degree
+// is d = 111.194927 km.
+//
+// The optimized route goes from the edge of the start, through the center
+// of the ESS, to the edge of the goal: the task is d-2 km and the speed
+// section d/2-1 km. Every pilot but the last leaves the start at 12:01,
+// 0.02° away, 0.48d km from the ESS.
+func TestScoreTask(t *testing.T) {
+	task := compTask{
+		Number: 1,
+		Day:    "2018-06-01",
+		Route: igc.Task{
+			Start:      igc.NewPointFromLatLng(0, 0),
+			Turnpoints: []igc.Point{igc.NewPointFromLatLng(0, 0.5)},
+			Finish:     igc.NewPointFromLatLng(0, 1),
+		},
+		Radii:   []int{1000, 1000, 1000},
+		ESS:     1,
+		SSS:     xcStart{Type: "RACE", Direction: "EXIT"},
+		Goal:    xcGoal{Type: "CYLINDER"},
+		Present: 5,
+		Entries: []compEntry{
+			{Track: 1, Pilot: "goal"},
+			{Track: 2, Pilot: "ess"},
+			{Track: 3, Pilot: "short"},
+			{Track: 4, Pilot: "no start"},
+		},
+	}
+	tracks := []igc.Track{
+		// ESS at 12:31, goal at 13:01
+		gapTestTrack("goal", map[int]float64{0: 0, 1: 0.02, 31: 0.5, 61: 1}),
+		// ESS at 12:41, landed at 0.8°, the last fix of the day at 13:10
+		gapTestTrack("ess", map[int]float64{0: 0, 1: 0.02, 41: 0.5, 70: 0.8}),
+		// landed at 0.35° at 12:40
+		gapTestTrack("short", map[int]float64{0: 0, 1: 0.02, 40: 0.35}),
+		// never left the start cylinder
+		gapTestTrack("no start", map[int]float64{0: 0, 30: 0.005}),
+	}
+	params := defaultGAPParams
+	params.NominalDistance = 100
+	params.ArrivalPoints = true
+	params.EarthModel = "FAI_SPHERE"
+
+	r := params.ScoreTask(task, tracks)
+
+	for _, c := range []struct {
+		name      string
+		got, want float64
+	}{
+		{"task distance", r.TaskDistance, 109.194927},
+		{"speed section", r.SpeedSection, 54.597463},
+		// 4 flying of 5 present: lvr = 4/(5*0.96)
+		{"launch validity", r.LaunchValidity, 0.923194},
+		// sum over the minimum distance of 0, 104.19, 82.96 and 32.92 km,
+		// over 4 times the area (1.3*95 + 0.3*9.19)/2
+		{"distance validity", r.DistanceValidity, 0.871502},
+		// best time of 30 minutes against the nominal 90
+		{"time validity", r.TimeValidity, 0.483481},
+		{"day quality", r.DayQuality, 0.388993},
+		{"available points", r.AvailablePoints, 388.992773},
+		// a quarter of the pilots in goal
+		{"distance weight", r.DistanceWeight, 0.581641},
+		{"time weight", r.TimeWeight, 0.292852},
+		{"leading weight", r.LeadingWeight, 0.073213},
+		{"arrival weight", r.ArrivalWeight, 0.052295},
+	} {
+		if math.Abs(c.got-c.want) > 1e-4 {
+			t.Errorf("%v: got %.6f, want %.6f", c.name, c.got, c.want)
+		}
+	}
+	if r.Present != 5 || r.Flying != 4 || r.InGoal != 1 {
+		t.Errorf("got %v present, %v flying, %v in goal", r.Present, r.Flying, r.InGoal)
+	}
+
+	want := []compResult{
+		{
+			Rank: 1, Pilot: "goal", Track: 1, Goal: true, SpeedTime: 1800, Arrival: 1,
+			Distance: 109.194927, LeadingCoefficient: 0.955669,
+			DistancePoints: 226.2540, TimePoints: 113.9171, LeadingPoints: 28.4793, ArrivalPoints: 20.3423,
+			Total: 389,
+		},
+		{
+			// 10 minutes slower, and 80% of the time and arrival points
+			// without goal
+			Rank: 2, Pilot: "ess", Track: 2, SpeedTime: 2400, Arrival: 2,
+			Distance: 87.955941, LeadingCoefficient: 1.274225,
+			DistancePoints: 182.2464, TimePoints: 63.8031, LeadingPoints: 14.9933, ArrivalPoints: 5.3724,
+			Total: 266,
+		},
+		{
+			// the remaining 0.15d km to the ESS counted until the last fix
+			// of the day
+			Rank: 3, Pilot: "short", Track: 3,
+			Distance: 37.918224, LeadingCoefficient: 1.335697,
+			DistancePoints: 78.5673, LeadingPoints: 13.3098,
+			Total: 92,
+		},
+		{
+			// the minimum distance of 5 km
+			Rank: 4, Pilot: "no start", Track: 4,
+			DistancePoints: 10.3601,
+			Total:          10,
+		},
+	}
+	if len(r.Results) != len(want) {
+		t.Fatalf("got %v results", len(r.Results))
+	}
+	for i, w := range want {
+		g := r.Results[i]
+		if g.Rank != w.Rank || g.Pilot != w.Pilot || g.Track != w.Track || g.Goal != w.Goal ||
+			g.Arrival != w.Arrival || g.SpeedTime != w.SpeedTime || g.Total != w.Total {
+			t.Errorf("result %v: got %+v, want %+v", i, g, w)
+			continue
+		}
+		if (g.Start == nil) != (w.Pilot == "no start") || (g.ESS == nil) != (w.Arrival == 0) {
+			t.Errorf("%v: got start %v, ESS %v", w.Pilot, g.Start, g.ESS)
+		}
+		for _, c := range []struct {
+			name      string
+			got, want float64
+		}{
+			{"distance", g.Distance, w.Distance},
+			{"leading coefficient", g.LeadingCoefficient, w.LeadingCoefficient},
+			{"distance points", g.DistancePoints, w.DistancePoints},
+			{"time points", g.TimePoints, w.TimePoints},
+			{"leading points", g.LeadingPoints, w.LeadingPoints},
+			{"arrival points", g.ArrivalPoints, w.ArrivalPoints},
+		} {
+			if math.Abs(c.got-c.want) > 0.01 {
+				t.Errorf("%v: got %v %.4f, want %.4f", w.Pilot, c.name, c.got, c.want)
+			}
+		}
+	}
+}
+
+// TestScoreTaskTies gives the same rank to equal totals
+func TestScoreTaskTies(t *testing.T) {
+	task := compTask{
+		Route: igc.Task{
+			Start:  igc.NewPointFromLatLng(0, 0),
+			Finish: igc.NewPointFromLatLng(0, 1),
+		},
+		Radii:   []int{1000, 1000},
+		ESS:     1,
+		SSS:     xcStart{Type: "RACE", Direction: "EXIT"},
+		Goal:    xcGoal{Type: "CYLINDER"},
+		Entries: []compEntry{{Track: 1, Pilot: "a"}, {Track: 2, Pilot: "b"}, {Track: 3, Pilot: "c"}},
+	}
+	tracks := []igc.Track{
+		gapTestTrack("a", map[int]float64{0: 0, 10: 0.4}),
+		gapTestTrack("b", map[int]float64{0: 0, 10: 0.6}),
+		gapTestTrack("c", map[int]float64{0: 0, 10: 0.4}),
+	}
+	params := defaultGAPParams
+	params.EarthModel = "FAI_SPHERE"
+	r := params.ScoreTask(task, tracks)
+	ranks := map[string]int{}
+	for _, res := range r.Results {
+		ranks[res.Pilot] = res.Rank
+	}
+	if ranks["b"] != 1 || ranks["a"] != 2 || ranks["c"] != 2 {
+		t.Errorf("got ranks %v", ranks)
+	}
+}
@@ -0,0 +1,548 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/geo/s2"
+	"github.com/marni/goigc"
+)
+
+// cupTaskSection separates the waypoints of a SeeYou .cup file from its tasks
+const cupTaskSection = "-----Related Tasks-----"
+
+// cupWaypoint is a waypoint of a SeeYou .cup file. Style is the SeeYou
+// waypoint style, eg. 1 for a plain waypoint or 7 for a mountain top.
+type cupWaypoint struct {
+	Name        string  `json:"name"`
+	Code        string  `json:"code"`
+	Country     string  `json:"country"`
+	Lat         float64 `json:"lat"`
+	Lng         float64 `json:"lng"`
+	Elevation   float64 `json:"elevation"` // m
+	Style       int     `json:"style"`
+	Description string  `json:"description"`
+}
+
+// cupZone is the observation zone of a task point: a sector of radius R1
+// and half angle A1 (180 for a cylinder), with an optional inner sector of
+// radius R2 and half angle A2, or a line of half length R1. Style gives the
+// direction of the sector: 0 fixed at A12 degrees, 1 symmetrical, 2 away
+// from the next point, 3 away from the previous point, 4 away from the start.
+type cupZone struct {
+	Style int     `json:"style"`
+	R1    float64 `json:"r1"` // m
+	A1    float64 `json:"a1"` // degrees
+	R2    float64 `json:"r2"`
+	A2    float64 `json:"a2"`
+	A12   float64 `json:"a12"`
+	Line  bool    `json:"line"`
+}
+
+// cupTask is a task of a SeeYou .cup file: its takeoff, start, turnpoints,
+// finish and landing, and the observation zone of every point from the
+// start to the finish
+type cupTask struct {
+	Description string        `json:"description"`
+	Points      []cupWaypoint `json:"points"`
+	Zones       []cupZone     `json:"zones"`
+	Options     []string      `json:"options,omitempty"` // Options line, as written
+}
+
+type cupFile struct {
+	Waypoints []cupWaypoint
+	Tasks     []cupTask
+}
+
+// defaultZone is the zone of task points without an ObsZone line, a
+// cylinder of turnpointRadius
+func defaultZone(style int) cupZone {
+	return cupZone{Style: style, R1: turnpointRadius * 1000, A1: 180}
+}
+
+// parseCUPCoordinate reads a DDMM.mmmN latitude or DDDMM.mmmE longitude
+func parseCUPCoordinate(s string, negative byte) (float64, error) {
+	s = strings.TrimSpace(s)
+	if len(s) < 2 {
+		return 0, fmt.Errorf("invalid coordinate '%v'", s)
+	}
+	v, err := strconv.ParseFloat(s[:len(s)-1], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid coordinate '%v'", s)
+	}
+	degrees := math.Floor(v / 100)
+	decimal := degrees + (v-degrees*100)/60
+	if s[len(s)-1] == negative {
+		decimal = -decimal
+	}
+	return decimal, nil
+}
+
+// parseCUPLength reads a length with its unit (m, km, ft, nm or ml) in meters
+func parseCUPLength(s string) (float64, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "" {
+		return 0, nil
+	}
+	for _, unit := range []struct {
+		suffix string
+		meters float64
+	}{{"km", 1000}, {"nm", nauticalMile * 1000}, {"ml", 1609.344}, {"ft", feet}, {"m", 1}} {
+		if strings.HasSuffix(s, unit.suffix) {
+			v, err := strconv.ParseFloat(strings.TrimSuffix(s, unit.suffix), 64)
+			if err != nil {
+				return 0, fmt.Errorf("invalid length '%v'", s)
+			}
+			return v * unit.meters, nil
+		}
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid length '%v'", s)
+	}
+	return v, nil
+}
+
+// cupColumns are the columns of the waypoints of a .cup file without a
+// header row. Newer files add rwwidth after rwlen, and userdata and pics
+// after desc, naming them in their header row.
+var cupColumns = []string{"name", "code", "country", "lat", "lon", "elev", "style", "rwdir", "rwlen", "freq", "desc"}
+
+// cupColumnIndex returns the index of the waypoint columns by name
+func cupColumnIndex(header []string) (map[string]int, error) {
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, name := range []string{"name", "lat", "lon"} {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("missing column '%v'", name)
+		}
+	}
+	return columns, nil
+}
+
+func parseCUPWaypoint(row []string, columns map[string]int) (cupWaypoint, error) {
+	if len(row) < 6 {
+		return cupWaypoint{}, fmt.Errorf("missing fields")
+	}
+	field := func(name string) string {
+		if i, ok := columns[name]; ok && i < len(row) {
+			return strings.TrimSpace(row[i])
+		}
+		return ""
+	}
+	wp := cupWaypoint{Name: field("name"), Code: field("code"), Country: field("country"), Description: field("desc")}
+	var err error
+	if wp.Lat, err = parseCUPCoordinate(field("lat"), 'S'); err != nil {
+		return wp, err
+	}
+	if wp.Lng, err = parseCUPCoordinate(field("lon"), 'W'); err != nil {
+		return wp, err
+	}
+	if wp.Elevation, err = parseCUPLength(field("elev")); err != nil {
+		return wp, err
+	}
+	if style := field("style"); style != "" {
+		if wp.Style, err = strconv.Atoi(style); err != nil {
+			return wp, fmt.Errorf("invalid style '%v'", style)
+		}
+	}
+	return wp, nil
+}
+
+// parseCUPZone reads an ObsZone line into the zones of the task
+func parseCUPZone(row []string, task *cupTask) error {
+	index := -1
+	zone := defaultZone(1)
+	for _, field := range row {
+		kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		var err error
+		switch strings.ToLower(kv[0]) {
+		case "obszone":
+			index, err = strconv.Atoi(kv[1])
+		case "style":
+			zone.Style, err = strconv.Atoi(kv[1])
+		case "r1":
+			zone.R1, err = parseCUPLength(kv[1])
+		case "a1":
+			zone.A1, err = strconv.ParseFloat(kv[1], 64)
+		case "r2":
+			zone.R2, err = parseCUPLength(kv[1])
+		case "a2":
+			zone.A2, err = strconv.ParseFloat(kv[1], 64)
+		case "a12":
+			zone.A12, err = strconv.ParseFloat(kv[1], 64)
+		case "line":
+			zone.Line = kv[1] == "1"
+		}
+		if err != nil {
+			return fmt.Errorf("invalid %v", kv[0])
+		}
+	}
+	if index < 0 || index >= len(task.Zones) {
+		return fmt.Errorf("no task point %v", index)
+	}
+	task.Zones[index] = zone
+	return nil
+}
+
+// parseCUP reads the waypoints and tasks of a SeeYou .cup file. The points
+// of a task refer to the waypoints by name; inline Point= definitions are
+// not supported.
+func parseCUP(r io.Reader) (cupFile, error) {
+	var file cupFile
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	reader.TrimLeadingSpace = true
+
+	columns, _ := cupColumnIndex(cupColumns)
+	byName := make(map[string]cupWaypoint)
+	tasks := false
+	for line := 1; ; line++ {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return file, err
+		}
+		first := strings.TrimSpace(row[0])
+		switch {
+		case first == "" && len(row) == 1:
+		case strings.HasPrefix(first, "-----Related Tasks"):
+			tasks = true
+		case !tasks && line == 1 && strings.EqualFold(first, "name"):
+			if columns, err = cupColumnIndex(row); err != nil {
+				return file, fmt.Errorf("line %v: %v", line, err)
+			}
+		case !tasks:
+			wp, err := parseCUPWaypoint(row, columns)
+			if err != nil {
+				return file, fmt.Errorf("line %v: %v", line, err)
+			}
+			file.Waypoints = append(file.Waypoints, wp)
+			byName[wp.Name] = wp
+		case strings.HasPrefix(first, "Options"):
+			if len(file.Tasks) > 0 {
+				file.Tasks[len(file.Tasks)-1].Options = row[1:]
+			}
+		case strings.HasPrefix(first, "ObsZone="):
+			if len(file.Tasks) == 0 {
+				return file, fmt.Errorf("line %v: observation zone without task", line)
+			}
+			if err := parseCUPZone(row, &file.Tasks[len(file.Tasks)-1]); err != nil {
+				return file, fmt.Errorf("line %v: %v", line, err)
+			}
+		case strings.HasPrefix(first, "Point=") || strings.HasPrefix(first, "STARTS="):
+		default:
+			task := cupTask{Description: first}
+			for _, name := range row[1:] {
+				name = strings.TrimSpace(name)
+				if name == "" {
+					continue
+				}
+				wp, ok := byName[name]
+				if !ok && name != "???" {
+					return file, fmt.Errorf("line %v: unknown waypoint '%v'", line, name)
+				}
+				if !ok {
+					wp = cupWaypoint{Name: name}
+				}
+				task.Points = append(task.Points, wp)
+			}
+			if len(task.Points) < 4 {
+				return file, fmt.Errorf("line %v: a task needs a takeoff, start, finish and landing", line)
+			}
+			task.Zones = make([]cupZone, len(task.Points)-2)
+			for i := range task.Zones {
+				switch i {
+				case 0:
+					task.Zones[i] = defaultZone(2)
+				case len(task.Zones) - 1:
+					task.Zones[i] = defaultZone(3)
+				default:
+					task.Zones[i] = defaultZone(1)
+				}
+			}
+			file.Tasks = append(file.Tasks, task)
+		}
+	}
+	return file, nil
+}
+
+// cupQuote returns s as a quoted .cup field
+func cupQuote(s string) string {
+	return `"` + strings.Replace(s, `"`, `'`, -1) + `"`
+}
+
+// cupCoordinate returns a DDMM.mmmN latitude or DDDMM.mmmE longitude
+func cupCoordinate(v float64, lat bool) string {
+	hemisphere := "N"
+	if !lat {
+		hemisphere = "E"
+	}
+	if v < 0 {
+		v = -v
+		hemisphere = map[bool]string{true: "S", false: "W"}[lat]
+	}
+	degrees := math.Floor(v)
+	minutes := (v - degrees) * 60
+	if math.Round(minutes*1000) >= 60000 {
+		degrees, minutes = degrees+1, 0
+	}
+	if lat {
+		return fmt.Sprintf("%02.0f%06.3f%v", degrees, minutes, hemisphere)
+	}
+	return fmt.Sprintf("%03.0f%06.3f%v", degrees, minutes, hemisphere)
+}
+
+// cupLength returns a length in meters as written in .cup files
+func cupLength(meters float64) string {
+	return strconv.FormatFloat(meters, 'f', -1, 64) + "m"
+}
+
+// writeCUP writes the waypoints and tasks as a SeeYou .cup file
+func writeCUP(w io.Writer, file cupFile) error {
+	var b bytes.Buffer
+	b.WriteString("name,code,country,lat,lon,elev,style,rwdir,rwlen,freq,desc\r\n")
+	for _, wp := range file.Waypoints {
+		fmt.Fprintf(&b, "%v,%v,%v,%v,%v,%.1fm,%v,,,,%v\r\n",
+			cupQuote(wp.Name), cupQuote(wp.Code), wp.Country,
+			cupCoordinate(wp.Lat, true), cupCoordinate(wp.Lng, false),
+			wp.Elevation, wp.Style, cupQuote(wp.Description))
+	}
+	if len(file.Tasks) > 0 {
+		b.WriteString(cupTaskSection + "\r\n")
+	}
+	for _, task := range file.Tasks {
+		fields := []string{cupQuote(task.Description)}
+		for _, p := range task.Points {
+			fields = append(fields, cupQuote(p.Name))
+		}
+		b.WriteString(strings.Join(fields, ",") + "\r\n")
+		if len(task.Options) > 0 {
+			b.WriteString("Options," + strings.Join(task.Options, ",") + "\r\n")
+		}
+		for i, z := range task.Zones {
+			fmt.Fprintf(&b, "ObsZone=%v,Style=%v,R1=%v,A1=%v", i, z.Style, cupLength(z.R1), z.A1)
+			if z.R2 > 0 {
+				fmt.Fprintf(&b, ",R2=%v,A2=%v", cupLength(z.R2), z.A2)
+			}
+			if z.Style == 0 {
+				fmt.Fprintf(&b, ",A12=%v", z.A12)
+			}
+			if z.Line {
+				b.WriteString(",Line=1")
+			}
+			b.WriteString("\r\n")
+		}
+	}
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// cupTaskFromIGC returns the declared task of a track as a .cup task, with
+// cylinders of turnpointRadius, and the waypoints it goes through. Points
+// without a description are named after their place in the task.
+func cupTaskFromIGC(task igc.Task) cupFile {
+	points := []igc.Point{task.Takeoff, task.Start}
+	points = append(points, task.Turnpoints...)
+	points = append(points, task.Finish, task.Landing)
+
+	file := cupFile{Tasks: []cupTask{{Description: strings.TrimSpace(task.Description)}}}
+	t := &file.Tasks[0]
+	seen := make(map[string]bool)
+	for i, p := range points {
+		name := strings.TrimSpace(p.Description)
+		switch {
+		case name != "":
+		case i == 0:
+			name = "Takeoff"
+		case i == 1:
+			name = "Start"
+		case i == len(points)-2:
+			name = "Finish"
+		case i == len(points)-1:
+			name = "Landing"
+		default:
+			name = "TP" + strconv.Itoa(i-1)
+		}
+		wp := cupWaypoint{Name: name, Code: name, Lat: p.Lat.Degrees(), Lng: p.Lng.Degrees(), Style: 1}
+		if (i == 0 || i == len(points)-1) && p.LatLng == (s2.LatLng{}) {
+			wp = cupWaypoint{Name: "???"}
+		} else if !seen[name] {
+			seen[name] = true
+			file.Waypoints = append(file.Waypoints, wp)
+		}
+		t.Points = append(t.Points, wp)
+	}
+	for i := 1; i < len(points)-1; i++ {
+		switch i {
+		case 1:
+			t.Zones = append(t.Zones, defaultZone(2))
+		case len(points) - 2:
+			t.Zones = append(t.Zones, defaultZone(3))
+		default:
+			t.Zones = append(t.Zones, defaultZone(1))
+		}
+	}
+	return file
+}
+
+// findCUPTask returns the task of the given description or index, or the
+// first one if empty
+func findCUPTask(tasks []cupTask, key string) (cupTask, bool) {
+	if key == "" && len(tasks) > 0 {
+		return tasks[0], true
+	}
+	for _, t := range tasks {
+		if t.Description == key {
+			return t, true
+		}
+	}
+	if i, err := strconv.Atoi(key); err == nil && i >= 0 && i < len(tasks) {
+		return tasks[i], true
+	}
+	return cupTask{}, false
+}
+
+// verifiedPoint is a point of a verified task, with the time the pilot
+// reached its zone
+type verifiedPoint struct {
+	Name    string     `json:"name"`
+	Lat     float64    `json:"lat"`
+	Lng     float64    `json:"lng"`
+	Reached *time.Time `json:"reached"`
+}
+
+type taskVerification struct {
+	Task      string          `json:"task"`
+	Completed bool            `json:"completed"`
+	Distance  float64         `json:"distance"` // km between the point centers
+	Achieved  float64         `json:"achieved"` // km of the task flown
+	Points    []verifiedPoint `json:"points"`
+}
+
+// angleDiff returns the difference between two bearings in degrees, 0 to 180
+func angleDiff(a float64, b float64) float64 {
+	d := math.Mod(math.Abs(a-b), 360)
+	if d > 180 {
+		d = 360 - d
+	}
+	return d
+}
+
+// zoneDirection returns the bearing of the bisector of the zone of the
+// task point i, from the start (1) to the finish
+func (task cupTask) zoneDirection(i int) float64 {
+	center := task.latLng(i)
+	first, last := i == 1, i == len(task.Points)-2
+	zone := task.Zones[i-1]
+	style := zone.Style
+	if style == 1 && first {
+		style = 2
+	} else if style == 1 && last {
+		style = 3
+	}
+	switch style {
+	case 0:
+		return zone.A12
+	case 1:
+		// away from the course, bisecting the angle of the legs
+		in, out := bearing(center, task.latLng(i-1))*math.Pi/180, bearing(center, task.latLng(i+1))*math.Pi/180
+		mean := math.Atan2(math.Sin(in)+math.Sin(out), math.Cos(in)+math.Cos(out)) * 180 / math.Pi
+		return math.Mod(mean+180+360, 360)
+	case 2:
+		if last {
+			return math.Mod(bearing(center, task.latLng(i-1))+180, 360)
+		}
+		return math.Mod(bearing(center, task.latLng(i+1))+180, 360)
+	case 3:
+		if first {
+			return math.Mod(bearing(center, task.latLng(i+1))+180, 360)
+		}
+		return math.Mod(bearing(center, task.latLng(i-1))+180, 360)
+	default:
+		return math.Mod(bearing(center, task.latLng(1))+180, 360)
+	}
+}
+
+func (task cupTask) latLng(i int) s2.LatLng {
+	return s2.LatLngFromDegrees(task.Points[i].Lat, task.Points[i].Lng)
+}
+
+// inZone tells whether a position is inside the zone of the task point i,
+// or beyond its line for line zones: on the course side of a start line,
+// and past a finish line
+func (task cupTask) inZone(i int, ll s2.LatLng) bool {
+	zone := task.Zones[i-1]
+	center := task.latLng(i)
+	d := center.Distance(ll).Radians() * igc.EarthRadius * 1000
+	angle := angleDiff(bearing(center, ll), task.zoneDirection(i))
+	if zone.Line && i == len(task.Points)-2 {
+		return d <= zone.R1 && angle <= 90
+	}
+	if zone.Line {
+		return d <= zone.R1 && angle > 90
+	}
+	return (d <= zone.R1 && angle <= zone.A1) || (d <= zone.R2 && angle <= zone.A2)
+}
+
+// verifyTask checks the track against the task, in order: every zone is
+// reached when a fix is inside it, or crosses its line. The start is the
+// last one before reaching the first turnpoint.
+func verifyTask(track igc.Track, task cupTask) taskVerification {
+	n := len(task.Points)
+	v := taskVerification{Task: task.Description}
+	for i := 1; i < n-1; i++ {
+		p := task.Points[i]
+		v.Points = append(v.Points, verifiedPoint{Name: p.Name, Lat: p.Lat, Lng: p.Lng})
+		if i > 1 {
+			v.Distance += task.latLng(i-1).Distance(task.latLng(i)).Radians() * igc.EarthRadius
+		}
+	}
+
+	next := 1 // task point to reach next
+	done, progress := 0.0, 0.0
+	reached := func(i int, j int) bool {
+		points := track.Points
+		if task.Zones[i-1].Line {
+			return j > 0 && !task.inZone(i, points[j-1].LatLng) && task.inZone(i, points[j].LatLng)
+		}
+		return task.inZone(i, points[j].LatLng)
+	}
+	for j, p := range track.Points {
+		if next == 2 && reached(1, j) {
+			t := p.Time
+			v.Points[0].Reached = &t
+		}
+		for next < n-1 && reached(next, j) {
+			t := p.Time
+			v.Points[next-1].Reached = &t
+			if next > 1 {
+				done += task.latLng(next-1).Distance(task.latLng(next)).Radians() * igc.EarthRadius
+			}
+			next++
+			progress = 0
+		}
+		if next > 1 && next < n-1 {
+			leg := task.latLng(next-1).Distance(task.latLng(next)).Radians() * igc.EarthRadius
+			left := p.Distance(igc.Point{LatLng: task.latLng(next)})
+			progress = math.Max(progress, leg-left)
+		}
+	}
+	v.Completed = next == n-1
+	v.Achieved = done + progress
+	return v
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestParseCUPColumns(t *testing.T) {
+	want := []cupWaypoint{
+		{Name: "Hangur", Code: "HANG", Country: "NO", Lat: 60.6425, Lng: 6.391111, Elevation: 660, Style: 1, Description: "takeoff"},
+		{Name: "Signal Hill", Code: "SIG", Country: "ZA", Lat: -33.917, Lng: 18.4, Elevation: 350 * feet, Style: 7, Description: "south of the equator"},
+	}
+	for _, c := range []struct {
+		name string
+		file string
+	}{
+		{"no header", `"Hangur","HANG",NO,6038.550N,00623.467E,660.0m,1,,,,"takeoff"
+"Signal Hill","SIG",ZA,3355.020S,01824.000E,350ft,7,,,123.500,"south of the equator"
+`},
+		{"11 columns", `name,code,country,lat,lon,elev,style,rwdir,rwlen,freq,desc
+"Hangur","HANG",NO,6038.550N,00623.467E,660.0m,1,,,,"takeoff"
+"Signal Hill","SIG",ZA,3355.020S,01824.000E,350ft,7,,,123.500,"south of the equator"
+`},
+		{"14 columns", `name,code,country,lat,lon,elev,style,rwdir,rwlen,rwwidth,freq,desc,userdata,pics
+"Hangur","HANG",NO,6038.550N,00623.467E,660.0m,1,,,,,"takeoff","user",""
+"Signal Hill","SIG",ZA,3355.020S,01824.000E,350ft,7,90,800m,30m,123.500,"south of the equator","","hill.jpg"
+`},
+		{"reordered", `Name,Lat,Lon,Desc,Code,Country,Elev,Style
+"Hangur",6038.550N,00623.467E,"takeoff","HANG",NO,660.0m,1
+"Signal Hill",3355.020S,01824.000E,"south of the equator","SIG",ZA,350ft,7
+`},
+	} {
+		file, err := parseCUP(strings.NewReader(c.file))
+		if err != nil {
+			t.Errorf("%v: %v", c.name, err)
+			continue
+		}
+		if len(file.Waypoints) != len(want) {
+			t.Errorf("%v: got %v waypoints", c.name, len(file.Waypoints))
+			continue
+		}
+		for i, w := range want {
+			g := file.Waypoints[i]
+			if g.Name != w.Name || g.Code != w.Code || g.Country != w.Country || g.Style != w.Style || g.Description != w.Description ||
+				math.Abs(g.Lat-w.Lat) > 1e-5 || math.Abs(g.Lng-w.Lng) > 1e-5 || math.Abs(g.Elevation-w.Elevation) > 1e-9 {
+				t.Errorf("%v: got %+v, want %+v", c.name, g, w)
+			}
+		}
+	}
+
+	if _, err := parseCUP(strings.NewReader("name,code,country,lon,elev,style\n")); err == nil {
+		t.Errorf("no error without a lat column")
+	}
+}
+
+func TestWriteCUP(t *testing.T) {
+	file := cupFile{Waypoints: []cupWaypoint{
+		{Name: "Hangur", Code: "HANG", Country: "NO", Lat: 60.6425, Lng: 6.391111, Elevation: 660, Style: 1, Description: "takeoff"},
+	}}
+	var b bytes.Buffer
+	if err := writeCUP(&b, file); err != nil {
+		t.Fatal(err)
+	}
+	got, err := parseCUP(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Waypoints) != 1 || got.Waypoints[0].Description != "takeoff" || got.Waypoints[0].Style != 1 {
+		t.Errorf("got %+v", got.Waypoints)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/marni/goigc"
+)
+
+// simplifyTrack reduces the fixes of a track to the given resolution: a
+// tolerance in meters ("50m"), an interval in seconds ("30s") or a number
+// of fixes ("1000"). The fixes of the contest route are always kept.
+func simplifyTrack(track igc.Track, resolution string) (igc.Track, error) {
+	if resolution == "" {
+		return track, nil
+	}
+	_, route := contestRoute(track.Points)
+	switch {
+	case strings.HasSuffix(resolution, "m"):
+		tolerance, err := strconv.ParseFloat(strings.TrimSuffix(resolution, "m"), 64)
+		if err != nil || tolerance < 0 {
+			return track, fmt.Errorf("invalid resolution")
+		}
+		return track.Simplify(tolerance, route...), nil
+	case strings.HasSuffix(resolution, "s"):
+		seconds, err := strconv.Atoi(strings.TrimSuffix(resolution, "s"))
+		if err != nil || seconds < 1 {
+			return track, fmt.Errorf("invalid resolution")
+		}
+		return track.Downsample(time.Duration(seconds)*time.Second, route...), nil
+	default:
+		n, err := strconv.Atoi(resolution)
+		if err != nil || n < 2 {
+			return track, fmt.Errorf("invalid resolution")
+		}
+		return track.SimplifyTo(n, route...), nil
+	}
+}
+
+type exportPoint struct {
+	Time             time.Time `json:"time"`
+	Lat              float64   `json:"lat"`
+	Lng              float64   `json:"lng"`
+	GNSSAltitude     int64     `json:"gnss_altitude"`
+	PressureAltitude int64     `json:"pressure_altitude"`
+	Terrain          *float64  `json:"terrain,omitempty"`
+	AGL              *float64  `json:"agl,omitempty"`
+}
+
+// exportPoints returns the fixes of the track, with the terrain elevation
+// and height above it where known
+func exportPoints(track igc.Track) []exportPoint {
+	points := make([]exportPoint, len(track.Points))
+	for i, p := range track.Points {
+		points[i] = exportPoint{
+			Time:             p.Time,
+			Lat:              p.Lat.Degrees(),
+			Lng:              p.Lng.Degrees(),
+			GNSSAltitude:     p.GNSSAltitude,
+			PressureAltitude: p.PressureAltitude,
+		}
+		if elevation, ok := terrain.Elevation(p.LatLng); ok {
+			agl := float64(altitude(p)) - elevation
+			points[i].Terrain, points[i].AGL = &elevation, &agl
+		}
+	}
+	return points
+}
+
+// exportGeoJSON returns the track as a GeoJSON feature, a line string of
+// lng, lat and altitude with the time of every fix in its coordTimes
+func exportGeoJSON(info trackInfo, track igc.Track) gin.H {
+	coordinates := make([][3]float64, len(track.Points))
+	times := make([]time.Time, len(track.Points))
+	for i, p := range track.Points {
+		coordinates[i] = [3]float64{p.Lng.Degrees(), p.Lat.Degrees(), float64(altitude(p))}
+		times[i] = p.Time
+	}
+	return gin.H{
+		"type": "Feature",
+		"geometry": gin.H{
+			"type":        "LineString",
+			"coordinates": coordinates,
+		},
+		"properties": gin.H{
+			"id":         info.ID,
+			"pilot":      info.Pilot,
+			"glider":     info.Glider,
+			"coordTimes": times,
+		},
+	}
+}
+
+// exportKML returns the track as a KML document with a timed gx:Track
+func exportKML(info trackInfo, track igc.Track) []byte {
+	var name bytes.Buffer
+	xml.EscapeText(&name, []byte(strings.TrimSpace(info.Pilot+" "+info.HDate)))
+
+	var b bytes.Buffer
+	b.WriteString(xml.Header)
+	b.WriteString(`<kml xmlns="http://www.opengis.net/kml/2.2" xmlns:gx="http://www.google.com/kml/ext/2.2">` + "\n")
+	b.WriteString("<Document>\n<Placemark>\n")
+	fmt.Fprintf(&b, "<name>%s</name>\n", name.String())
+	b.WriteString("<gx:Track>\n<altitudeMode>absolute</altitudeMode>\n")
+	for _, p := range track.Points {
+		fmt.Fprintf(&b, "<when>%s</when>\n", p.Time.UTC().Format(time.RFC3339))
+	}
+	for _, p := range track.Points {
+		fmt.Fprintf(&b, "<gx:coord>%.6f %.6f %d</gx:coord>\n", p.Lng.Degrees(), p.Lat.Degrees(), altitude(p))
+	}
+	b.WriteString("</gx:Track>\n</Placemark>\n</Document>\n</kml>\n")
+	return b.Bytes()
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/globalsign/mgo/bson"
+	"gopkg.in/yaml.v2"
+)
+
+// gliderModel is a canonical glider model in the registry.
+//
+// Class is the certification class, eg. EN A to EN D and CCC for
+// paragliders, or Club, Standard, 15m, 18m, 20m Two-Seater and Open for
+// sailplanes. Aliases are the other ways the model is written in HFGTY
+// headers, and GliderIDs the HFGID of the registered gliders of this model.
+type gliderModel struct {
+	Model        string   `yaml:"model" json:"model"`
+	Manufacturer string   `yaml:"manufacturer" json:"manufacturer"`
+	Class        string   `yaml:"class" json:"class"`
+	Handicap     float64  `yaml:"handicap" json:"handicap"`
+	Aliases      []string `yaml:"aliases" json:"aliases,omitempty"`
+	GliderIDs    []string `yaml:"glider_ids" json:"glider_ids,omitempty"`
+}
+
+// key identifies the model in the track store and the API
+func (m gliderModel) key() string {
+	return normalizeWords(m.Manufacturer + " " + m.Model)
+}
+
+type gliderRegistry struct {
+	models  []gliderModel
+	byName  map[string]int // normalized model names and aliases
+	byID    map[string]int // normalized glider ids
+	byModel map[string]int // model keys
+}
+
+var gliders = newGliderRegistry(nil)
+
+func newGliderRegistry(models []gliderModel) *gliderRegistry {
+	r := &gliderRegistry{
+		models:  models,
+		byName:  make(map[string]int),
+		byID:    make(map[string]int),
+		byModel: make(map[string]int),
+	}
+	for i, m := range models {
+		r.byModel[m.key()] = i
+		r.byName[m.key()] = i
+		r.byName[normalizeWords(m.Model)] = i
+		for _, alias := range m.Aliases {
+			r.byName[normalizeWords(alias)] = i
+		}
+		for _, id := range m.GliderIDs {
+			r.byID[normalizeWords(id)] = i
+		}
+	}
+	return r
+}
+
+// loadGliderRegistry reads the glider models from a .csv, .yaml or .yml file.
+//
+// The YAML file is a list of models with the fields of gliderModel. The CSV
+// file has a header row naming the columns model, manufacturer, class,
+// handicap, aliases and glider_ids, with the last two separated by ';'.
+func loadGliderRegistry(path string) (*gliderRegistry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var models []gliderModel
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		data, err := ioutil.ReadAll(file)
+		if err != nil {
+			return nil, err
+		}
+		err = yaml.Unmarshal(data, &models)
+		if err != nil {
+			return nil, err
+		}
+	case ".csv":
+		models, err = readGliderCSV(file)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown glider registry format '%v'", filepath.Ext(path))
+	}
+
+	for i, m := range models {
+		if m.Model == "" {
+			return nil, fmt.Errorf("glider %v has no model name", i+1)
+		}
+	}
+	return newGliderRegistry(models), nil
+}
+
+func readGliderCSV(r io.Reader) ([]gliderModel, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err != nil {
+		return nil, err
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	get := func(row []string, name string) string {
+		if i, ok := columns[name]; ok && i < len(row) {
+			return strings.TrimSpace(row[i])
+		}
+		return ""
+	}
+	list := func(s string) []string {
+		var values []string
+		for _, v := range strings.Split(s, ";") {
+			if v = strings.TrimSpace(v); v != "" {
+				values = append(values, v)
+			}
+		}
+		return values
+	}
+
+	var models []gliderModel
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		m := gliderModel{
+			Model:        get(row, "model"),
+			Manufacturer: get(row, "manufacturer"),
+			Class:        get(row, "class"),
+			Aliases:      list(get(row, "aliases")),
+			GliderIDs:    list(get(row, "glider_ids")),
+		}
+		if handicap := get(row, "handicap"); handicap != "" {
+			m.Handicap, err = strconv.ParseFloat(handicap, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid handicap for %v: %v", m.Model, err)
+			}
+		}
+		models = append(models, m)
+	}
+	return models, nil
+}
+
+// Match returns the model of a glider, looked up by its registered glider
+// id first and then by its free text type.
+func (r *gliderRegistry) Match(gliderType string, gliderID string) (gliderModel, bool) {
+	if i, ok := r.byID[normalizeWords(gliderID)]; ok && gliderID != "" {
+		return r.models[i], true
+	}
+	if i, ok := r.byName[normalizeWords(gliderType)]; ok {
+		return r.models[i], true
+	}
+	return gliderModel{}, false
+}
+
+// Model returns the model with the given key or name.
+func (r *gliderRegistry) Model(name string) (gliderModel, bool) {
+	if i, ok := r.byModel[normalizeWords(name)]; ok {
+		return r.models[i], true
+	}
+	if i, ok := r.byName[normalizeWords(name)]; ok {
+		return r.models[i], true
+	}
+	return gliderModel{}, false
+}
+
+// setGlider fills the canonical glider model and class of a track
+func (t *trackInfo) setGlider(r *gliderRegistry) {
+	t.GliderModel, t.GliderClass = "", ""
+	if m, ok := r.Match(t.Glider, t.GliderID); ok {
+		t.GliderModel, t.GliderClass = m.key(), m.Class
+	}
+}
+
+// applyGliderRegistry updates the glider model and class of every stored
+// track, so they follow changes to the registry file.
+func (db TrackDB) applyGliderRegistry(r *gliderRegistry) {
+	collection := getCollection(db)
+	defer collection.Database.Session.Close()
+	var tracks []trackInfo
+	err := collection.Find(nil).Select(bson.M{
+		"id": 1, "glider": 1, "glider_id": 1, "glider_model": 1, "glider_class": 1,
+	}).All(&tracks)
+	if err != nil {
+		panic(err)
+	}
+	for _, t := range tracks {
+		model, class := t.GliderModel, t.GliderClass
+		t.setGlider(r)
+		if t.GliderModel == model && t.GliderClass == class {
+			continue
+		}
+		err := collection.Update(bson.M{"id": t.ID}, bson.M{"$set": bson.M{
+			"glider_model": t.GliderModel,
+			"glider_class": t.GliderClass,
+		}})
+		if err != nil {
+			panic(err)
+		}
+		db.publishTrack("updated", t.ID)
+	}
+}
+
+// backfillGliderIDKeys sets the glider id key of tracks stored before it
+// existed
+func (db TrackDB) backfillGliderIDKeys() {
+	collection := getCollection(db)
+	defer collection.Database.Session.Close()
+	var tracks []trackInfo
+	err := collection.Find(bson.M{"glider_id_key": bson.M{"$exists": false}}).Select(bson.M{"id": 1, "glider_id": 1}).All(&tracks)
+	if err != nil {
+		panic(err)
+	}
+	for _, t := range tracks {
+		err := collection.Update(bson.M{"id": t.ID}, bson.M{"$set": bson.M{"glider_id_key": normalizeWords(t.GliderID)}})
+		if err != nil {
+			panic(err)
+		}
+	}
+}
+
+type gliderStats struct {
+	gliderModel     `bson:"-"`
+	Key             string           `bson:"_id" json:"key"`
+	Flights         int              `bson:"flights" json:"flights"`
+	Pilots          int              `bson:"pilots" json:"pilots"`
+	Airtime         int64            `bson:"airtime" json:"airtime"`
+	TotalDistance   float64          `bson:"total_distance" json:"total_distance"`
+	LongestDistance float64          `bson:"longest_distance" json:"longest_distance"`
+	HighestAltitude int64            `bson:"highest_altitude" json:"highest_altitude"`
+	Tracks          map[string][]int `bson:"-" json:"tracks,omitempty"`
+}
+
+func (db TrackDB) gliderStats(match bson.M) map[string]gliderStats {
+	var stats []gliderStats
+	collection := getCollection(db)
+	defer collection.Database.Session.Close()
+	err := collection.Pipe([]bson.M{
+		{"$match": match},
+		{"$group": bson.M{
+			"_id":              "$glider_model",
+			"flights":          bson.M{"$sum": 1},
+			"pilot_keys":       bson.M{"$addToSet": "$pilot_key"},
+			"airtime":          bson.M{"$sum": "$airtime"},
+			"total_distance":   bson.M{"$sum": "$calculated total track length"},
+			"longest_distance": bson.M{"$max": "$calculated total track length"},
+			"highest_altitude": bson.M{"$max": "$max_altitude"},
+		}},
+		{"$project": bson.M{
+			"flights": 1, "airtime": 1, "total_distance": 1, "longest_distance": 1, "highest_altitude": 1,
+			"pilots": bson.M{"$size": "$pilot_keys"},
+		}},
+	}).All(&stats)
+	if err != nil {
+		panic(err)
+	}
+	byModel := make(map[string]gliderStats)
+	for _, s := range stats {
+		byModel[s.Key] = s
+	}
+	return byModel
+}
+
+// GetGliders returns every registered model with the statistics of its flights
+func (db TrackDB) GetGliders(r *gliderRegistry) []gliderStats {
+	stats := db.gliderStats(bson.M{"glider_model": bson.M{"$ne": ""}})
+	result := make([]gliderStats, len(r.models))
+	for i, m := range r.models {
+		s := stats[m.key()]
+		s.gliderModel, s.Key = m, m.key()
+		result[i] = s
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Key < result[j].Key })
+	return result
+}
+
+// GetGlider returns a registered model with the statistics of its flights,
+// and the ids of the tracks flown by each of its registered gliders.
+func (db TrackDB) GetGlider(r *gliderRegistry, name string) (gliderStats, bool) {
+	m, ok := r.Model(name)
+	if !ok {
+		return gliderStats{}, false
+	}
+	s := db.gliderStats(bson.M{"glider_model": m.key()})[m.key()]
+	s.gliderModel, s.Key = m, m.key()
+
+	s.Tracks = make(map[string][]int)
+	collection := getCollection(db)
+	defer collection.Database.Session.Close()
+	for _, id := range m.GliderIDs {
+		var tracks []trackInfo
+		err := collection.Find(bson.M{"glider_id_key": normalizeWords(id)}).Select(bson.M{"id": 1}).Sort("id").All(&tracks)
+		if err != nil {
+			panic(err)
+		}
+		ids := make([]int, len(tracks))
+		for i := range tracks {
+			ids[i] = tracks[i].ID
+		}
+		s.Tracks[id] = ids
+	}
+	return s, true
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/globalsign/mgo/bson"
+)
+
+// leaderboardMetric ranks pilots by a field stored on every track, either
+// by their best flight or by the sum over all their flights
+type leaderboardMetric struct {
+	field string
+	sum   bool
+}
+
+// Metrics pilots can be ranked by, by name in the API
+var leaderboardMetrics = map[string]leaderboardMetric{
+	"distance": {field: "calculated total track length"},
+	"score":    {field: "score"},
+	"airtime":  {field: "airtime", sum: true},
+	"climb":    {field: "max_climb"},
+}
+
+// Default number of pilots on a leaderboard
+const leaderboardSize = 10
+
+type leaderboardEntry struct {
+	Rank    int     `bson:"-" json:"rank"`
+	Key     string  `bson:"_id" json:"key"`
+	Pilot   string  `bson:"pilot" json:"pilot"`
+	Value   float64 `bson:"value" json:"value"`
+	TrackID *int    `bson:"track" json:"track,omitempty"`
+	Flights int     `bson:"flights" json:"flights"`
+}
+
+type leaderboard struct {
+	Metric  string             `json:"metric"`
+	From    time.Time          `json:"from"`
+	To      time.Time          `json:"to"`
+	Entries []leaderboardEntry `json:"entries"`
+}
+
+// seasonStart returns the first month of the season, from SEASON_START_MONTH (default January)
+func seasonStart() time.Month {
+	if m, err := strconv.Atoi(os.Getenv("SEASON_START_MONTH")); err == nil && m >= 1 && m <= 12 {
+		return time.Month(m)
+	}
+	return time.January
+}
+
+// parsePeriod returns the [from, to) time range of a leaderboard request.
+//
+// period is one of day (date=YYYY-MM-DD), month (date=YYYY-MM), season
+// (season=YYYY, the year the season starts) or custom (from, to), and
+// defaults to the current season.
+func parsePeriod(c *gin.Context, now time.Time) (time.Time, time.Time, error) {
+	now = now.UTC()
+	switch c.DefaultQuery("period", "season") {
+	case "day":
+		day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+		if date := c.Query("date"); date != "" {
+			var err error
+			if day, err = time.Parse("2006-01-02", date); err != nil {
+				return day, day, fmt.Errorf("invalid date")
+			}
+		}
+		return day, day.AddDate(0, 0, 1), nil
+	case "month":
+		month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+		if date := c.Query("date"); date != "" {
+			var err error
+			if month, err = time.Parse("2006-01", date); err != nil {
+				return month, month, fmt.Errorf("invalid date")
+			}
+		}
+		return month, month.AddDate(0, 1, 0), nil
+	case "season":
+		start := seasonStart()
+		year := now.Year()
+		if now.Month() < start {
+			year--
+		}
+		if season := c.Query("season"); season != "" {
+			var err error
+			if year, err = strconv.Atoi(season); err != nil {
+				return now, now, fmt.Errorf("invalid season")
+			}
+		}
+		from := time.Date(year, start, 1, 0, 0, 0, 0, time.UTC)
+		return from, from.AddDate(1, 0, 0), nil
+	case "custom":
+		from, err := parseTime(c.Query("from"))
+		if err != nil {
+			return from, from, fmt.Errorf("invalid from")
+		}
+		to, err := parseTime(c.Query("to"))
+		if err != nil {
+			return from, to, fmt.Errorf("invalid to")
+		}
+		if len(c.Query("to")) == len("2006-01-02") {
+			to = to.AddDate(0, 0, 1)
+		}
+		return from, to, nil
+	default:
+		return now, now, fmt.Errorf("invalid period '%v'", c.Query("period"))
+	}
+}
+
+// parseRegion reads a minLat,minLng,maxLat,maxLng bounding box
+func parseRegion(s string) ([4]float64, error) {
+	var box [4]float64
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return box, fmt.Errorf("invalid region")
+	}
+	for i, part := range parts {
+		v, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return box, fmt.Errorf("invalid region")
+		}
+		box[i] = v
+	}
+	return box, nil
+}
+
+// GetLeaderboard ranks the pilots by the given metric over the flights of
+// the period, read from the per-track results stored at registration.
+//
+// The optional filter restricts the flights counted, eg. to a glider class
+// or a takeoff region.
+func (db TrackDB) GetLeaderboard(metric string, from time.Time, to time.Time, filter bson.M, limit int) (leaderboard, error) {
+	m, ok := leaderboardMetrics[metric]
+	if !ok {
+		return leaderboard{}, fmt.Errorf("unknown metric '%v'", metric)
+	}
+
+	match := bson.M{
+		"flight_date": bson.M{"$gte": from, "$lt": to},
+		"pilot_key":   bson.M{"$ne": ""},
+	}
+	for k, v := range filter {
+		match[k] = v
+	}
+	value := bson.M{"$max": "$" + m.field}
+	track := bson.M{"$first": "$id"}
+	if m.sum {
+		value = bson.M{"$sum": "$" + m.field}
+		track = bson.M{"$first": nil}
+	}
+
+	board := leaderboard{Metric: metric, From: from, To: to, Entries: []leaderboardEntry{}}
+	collection := getCollection(db)
+	defer collection.Database.Session.Close()
+	err := collection.Pipe([]bson.M{
+		{"$match": match},
+		{"$sort": bson.M{m.field: -1}},
+		{"$group": bson.M{
+			"_id":     "$pilot_key",
+			"pilot":   bson.M{"$first": "$pilot"},
+			"value":   value,
+			"track":   track,
+			"flights": bson.M{"$sum": 1},
+		}},
+		{"$sort": bson.D{{Name: "value", Value: -1}, {Name: "_id", Value: 1}}},
+		{"$limit": limit},
+	}).All(&board.Entries)
+	if err != nil {
+		panic(err)
+	}
+	for i := range board.Entries {
+		board.Entries[i].Rank = i + 1
+	}
+	return board, nil
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/marni/goigc"
+)
+
+const (
+	// Default minutes without fixes after which a live session is closed
+	liveTimeout = 10
+	// Time between checks for inactive live sessions
+	liveCheckInterval = time.Minute
+	// Most fixes accepted in one batch
+	liveMaxBatch = 3600
+	// Time after which an unfinished close of a session is taken over
+	liveCloseLease = 5 * time.Minute
+)
+
+var (
+	errLiveNotFound = errors.New("no such live session")
+	errLiveClosed   = errors.New("live session closed")
+	errLiveToken    = errors.New("invalid live session token")
+)
+
+// liveStoreError is a database error of a live session, as opposed to the
+// errors of the request
+type liveStoreError struct{ error }
+
+// liveFix is a position sent by a live tracking device
+type liveFix struct {
+	Time             time.Time `bson:"time" json:"time"`
+	Lat              float64   `bson:"lat" json:"lat"`
+	Lng              float64   `bson:"lng" json:"lng"`
+	GNSSAltitude     int64     `bson:"gnss_altitude" json:"gnss_altitude"`
+	PressureAltitude int64     `bson:"pressure_altitude" json:"pressure_altitude"`
+	Climb            float64   `bson:"climb,omitempty" json:"climb,omitempty"` // m/s, when sent by the device
+}
+
+// liveSession is a flight followed live, stored as a regular track once it
+// is closed. The fixes are sent with the token, returned only when the
+// session is opened.
+type liveSession struct {
+	ID            string     `bson:"id" json:"session"`
+	Token         string     `bson:"token" json:"-"`
+	Pilot         string     `bson:"pilot" json:"pilot"`
+	Glider        string     `bson:"glider" json:"glider"`
+	GliderID      string     `bson:"glider_id" json:"glider_id"`
+	CompetitionID string     `bson:"competition_id" json:"competition_id"`
+	Device        string     `bson:"device,omitempty" json:"device,omitempty"` // OGN device id of beacon sessions
+	Started       time.Time  `bson:"started" json:"started"`
+	LastUpdate    time.Time  `bson:"last_update" json:"last_update"`
+	LastFix       *liveFix   `bson:"last_fix" json:"last_fix"`
+	Fixes         []liveFix  `bson:"fixes" json:"fixes,omitempty"`
+	Closed        bool       `bson:"closed" json:"closed"`
+	Closing       *time.Time `bson:"closing,omitempty" json:"-"`   // start of the close storing the track
+	Track         *int       `bson:"track" json:"track,omitempty"` // id of the stored track
+}
+
+func getLiveCollection(db TrackDB) *mgo.Collection {
+	return getNamedCollection(db, db.CollectionName+"Live")
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// OpenLiveSession starts a live session for the pilot and glider of the
+// given session
+func (db TrackDB) OpenLiveSession(s liveSession) (liveSession, error) {
+	now := time.Now()
+	s.ID = randomHex(8)
+	s.Token = randomHex(16)
+	s.Started, s.LastUpdate = now, now
+	s.LastFix, s.Fixes, s.Closed, s.Track = nil, []liveFix{}, false, nil
+	live := getLiveCollection(db)
+	defer live.Database.Session.Close()
+	if err := live.Insert(s); err != nil {
+		return liveSession{}, liveStoreError{err}
+	}
+	return s, nil
+}
+
+// LiveSession returns a live session, without its fixes before since
+func (db TrackDB) LiveSession(id string, since time.Time) (liveSession, bool) {
+	var s liveSession
+	live := getLiveCollection(db)
+	defer live.Database.Session.Close()
+	err := live.Find(bson.M{"id": id}).One(&s)
+	if err == mgo.ErrNotFound {
+		return s, false
+	}
+	if err != nil {
+		panic(err)
+	}
+	fixes := []liveFix{}
+	for _, f := range s.Fixes {
+		if f.Time.After(since) {
+			fixes = append(fixes, f)
+		}
+	}
+	s.Fixes = fixes
+	return s, true
+}
+
+// deviceSession returns the open live session of an OGN device
+func (db TrackDB) deviceSession(device string) (liveSession, bool, error) {
+	var s liveSession
+	live := getLiveCollection(db)
+	defer live.Database.Session.Close()
+	err := live.Find(bson.M{"device": device, "closed": false}).Select(bson.M{"fixes": 0}).One(&s)
+	if err == mgo.ErrNotFound {
+		return s, false, nil
+	}
+	if err != nil {
+		return s, false, liveStoreError{err}
+	}
+	return s, true, nil
+}
+
+// ActiveLiveSessions returns the open live sessions with their last fix,
+// leaving out their trail
+func (db TrackDB) ActiveLiveSessions() []liveSession {
+	sessions := []liveSession{}
+	live := getLiveCollection(db)
+	defer live.Database.Session.Close()
+	err := live.Find(bson.M{"closed": false, "last_fix": bson.M{"$ne": nil}}).
+		Select(bson.M{"fixes": 0}).Sort("id").All(&sessions)
+	if err != nil {
+		panic(err)
+	}
+	return sessions
+}
+
+// checkLiveToken returns a live session without its fixes, if the token
+// is the one of the open session
+func (db TrackDB) checkLiveToken(id string, token string) (liveSession, error) {
+	var s liveSession
+	live := getLiveCollection(db)
+	defer live.Database.Session.Close()
+	err := live.Find(bson.M{"id": id}).Select(bson.M{"fixes": 0}).One(&s)
+	if err == mgo.ErrNotFound {
+		return s, errLiveNotFound
+	}
+	if err != nil {
+		return s, liveStoreError{err}
+	}
+	if subtle.ConstantTimeCompare([]byte(s.Token), []byte(token)) != 1 {
+		return s, errLiveToken
+	}
+	if s.Closed {
+		return s, errLiveClosed
+	}
+	return s, nil
+}
+
+// AddLiveFixes appends a batch of fixes to an open session, returning the
+// count of fixes added. Fixes at or before the last one of the session are
+// skipped, so that a batch sent again after a lost response is not doubled.
+func (db TrackDB) AddLiveFixes(id string, token string, fixes []liveFix) (int, error) {
+	s, err := db.checkLiveToken(id, token)
+	if err != nil {
+		return 0, err
+	}
+	if len(fixes) > liveMaxBatch {
+		return 0, fmt.Errorf("more than %v fixes in a batch", liveMaxBatch)
+	}
+	for _, f := range fixes {
+		if f.Time.IsZero() || f.Lat < -90 || f.Lat > 90 || f.Lng < -180 || f.Lng > 180 {
+			return 0, fmt.Errorf("invalid fix at %v", f.Time)
+		}
+	}
+	sort.SliceStable(fixes, func(i, j int) bool { return fixes[i].Time.Before(fixes[j].Time) })
+
+	var added []liveFix
+	last := time.Time{}
+	if s.LastFix != nil {
+		last = s.LastFix.Time
+	}
+	for _, f := range fixes {
+		// whole seconds, as in IGC files
+		f.Time = f.Time.UTC().Truncate(time.Second)
+		if f.Time.After(last) {
+			added = append(added, f)
+			last = f.Time
+		}
+	}
+
+	update := bson.M{"$set": bson.M{"last_update": time.Now()}}
+	if len(added) > 0 {
+		update["$set"] = bson.M{"last_update": time.Now(), "last_fix": added[len(added)-1]}
+		update["$push"] = bson.M{"fixes": bson.M{"$each": added}}
+	}
+	// no fixes are added once the session is being stored
+	live := getLiveCollection(db)
+	defer live.Database.Session.Close()
+	err = live.Update(bson.M{"id": id, "closed": false, "closing": nil}, update)
+	if err == mgo.ErrNotFound {
+		return 0, errLiveClosed
+	}
+	if err != nil {
+		return 0, liveStoreError{err}
+	}
+	return len(added), nil
+}
+
+// liveStatus returns the response code of a live session error
+func liveStatus(err error) int {
+	if _, ok := err.(liveStoreError); ok {
+		return http.StatusInternalServerError
+	}
+	switch err {
+	case errLiveNotFound:
+		return http.StatusNotFound
+	case errLiveToken:
+		return http.StatusForbidden
+	case errLiveClosed:
+		return http.StatusConflict
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+// liveTrack returns the fixes of a session as an IGC track
+func liveTrack(s liveSession) igc.Track {
+	track := igc.NewTrack()
+	track.Manufacturer = "XXX"
+	track.UniqueID = "LIV"
+	track.AdditionalData = " live session " + s.ID
+	first := s.Fixes[0].Time.UTC()
+	track.Date = time.Date(first.Year(), first.Month(), first.Day(), 0, 0, 0, 0, time.UTC)
+	track.Pilot = s.Pilot
+	track.GliderType = s.Glider
+	track.GliderID = s.GliderID
+	track.CompetitionID = s.CompetitionID
+	for _, f := range s.Fixes {
+		track.Points = append(track.Points, f.point())
+	}
+	return track
+}
+
+// point returns the fix as an IGC fix
+func (f liveFix) point() igc.Point {
+	p := igc.NewPointFromLatLng(f.Lat, f.Lng)
+	p.Time = f.Time.UTC()
+	p.FixValidity = 'A'
+	p.GNSSAltitude = f.GNSSAltitude
+	p.PressureAltitude = f.PressureAltitude
+	return p
+}
+
+// simplifyLiveFixes reduces a trail to the given resolution, as
+// simplifyTrack does with the fixes of a track
+func simplifyLiveFixes(fixes []liveFix, resolution string) ([]liveFix, error) {
+	track := igc.NewTrack()
+	for _, f := range fixes {
+		track.Points = append(track.Points, f.point())
+	}
+	simplified, err := simplifyTrack(track, resolution)
+	if err != nil {
+		return fixes, err
+	}
+	// the kept fixes are in order, and a trail has one fix per second
+	kept := make([]liveFix, 0, len(simplified.Points))
+	i := 0
+	for _, p := range simplified.Points {
+		for !fixes[i].Time.Equal(p.Time) {
+			i++
+		}
+		kept = append(kept, fixes[i])
+	}
+	return kept, nil
+}
+
+// CloseLiveSession ends a session, checking its token unless empty, and
+// stores its fixes as a track. Sessions without fixes are only closed.
+//
+// The session is marked closed once its track is stored, so a session
+// that fails to be stored stays open, and is stored by the next close.
+func (db TrackDB) CloseLiveSession(id string, token string) (liveSession, error) {
+	if token != "" {
+		if _, err := db.checkLiveToken(id, token); err != nil {
+			return liveSession{}, err
+		}
+	}
+	// Only the first of concurrent closes stores the track, another one
+	// taking over if it has not finished after liveCloseLease
+	collection := getLiveCollection(db)
+	defer collection.Database.Session.Close()
+	now := time.Now()
+	var s liveSession
+	_, err := collection.Find(bson.M{
+		"id":      id,
+		"closed":  false,
+		"closing": bson.M{"$not": bson.M{"$gt": now.Add(-liveCloseLease)}},
+	}).Apply(mgo.Change{Update: bson.M{"$set": bson.M{"closing": now}}, ReturnNew: true}, &s)
+	if err == mgo.ErrNotFound {
+		return liveSession{}, errLiveClosed
+	}
+	if err != nil {
+		return liveSession{}, err
+	}
+
+	set := bson.M{"closed": true}
+	if len(s.Fixes) > 0 {
+		info, err := db.storeLiveTrack(s)
+		if err != nil {
+			if err := collection.Update(bson.M{"id": id}, bson.M{"$unset": bson.M{"closing": ""}}); err != nil {
+				log.Println("live:", id, err)
+			}
+			return s, err
+		}
+		s.Track = &info.ID
+		set["track"] = info.ID
+	}
+	err = collection.Update(bson.M{"id": id}, bson.M{"$set": set, "$unset": bson.M{"closing": ""}})
+	if err != nil {
+		return s, err
+	}
+	s.Closed, s.Closing = true, nil
+	return s, nil
+}
+
+// storeLiveTrack stores the fixes of a session as a track, returning the
+// database errors RegisterTrack panics with. A track stored by an earlier
+// close that failed afterwards is returned as is.
+func (db TrackDB) storeLiveTrack(s liveSession) (info trackInfo, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	url := "live:" + s.ID
+	collection := getCollection(db)
+	defer collection.Database.Session.Close()
+	err = collection.Find(bson.M{"track_src_url": url}).One(&info)
+	if err != mgo.ErrNotFound {
+		return info, err
+	}
+	return db.ImportTrack(liveTrack(s), url)
+}
+
+// closeInactiveSessions closes the live sessions without fixes for longer
+// than timeout, checking every liveCheckInterval
+func (db TrackDB) closeInactiveSessions(timeout time.Duration) {
+	for range time.Tick(liveCheckInterval) {
+		db.closeSessionsIdleFor(timeout)
+	}
+}
+
+// closeSessionsIdleFor closes the open sessions without fixes for longer
+// than timeout, logging the errors to try them again at the next check
+func (db TrackDB) closeSessionsIdleFor(timeout time.Duration) {
+	defer logPanic("live")
+	var sessions []liveSession
+	live := getLiveCollection(db)
+	defer live.Database.Session.Close()
+	err := live.Find(bson.M{
+		"closed":      false,
+		"last_update": bson.M{"$lt": time.Now().Add(-timeout)},
+	}).Select(bson.M{"id": 1}).All(&sessions)
+	if err != nil {
+		log.Println("live:", err)
+		return
+	}
+	for _, s := range sessions {
+		if _, err := db.CloseLiveSession(s.ID, ""); err != nil && err != errLiveClosed {
+			log.Println("live:", s.ID, err)
+		}
+	}
+}
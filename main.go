@@ -1,12 +1,18 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
 	"math"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/globalsign/mgo"
@@ -21,14 +27,102 @@ var (
 )
 
 type trackInfo struct {
-	ID          int     `bson:"id" json:"id"`
-	TrackLength float64 `bson:"calculated total track length" json:"calculated total track length"`
-	Pilot       string  `bson:"pilot" json:"pilot"`
-	Glider      string  `bson:"glider" json:"glider"`
-	GliderID    string  `bson:"glider_id" json:"glider_id"`
-	HDate       string  `bson:"h_date" json:"h_date"`
-	URL         string  `bson:"track_src_url" json:"url"`
-	TimeStamp   string  `bson:"timestamp" json:"timestamp"`
+	ID               int            `bson:"id" json:"id"`
+	TrackLength      float64        `bson:"calculated total track length" json:"calculated total track length"`
+	TrackLengthWGS84 float64        `bson:"track_length_wgs84" json:"track_length_wgs84"`
+	Score            float64        `bson:"score" json:"score"`
+	Airtime          int64          `bson:"airtime" json:"airtime"`
+	MaxAltitude      int64          `bson:"max_altitude" json:"max_altitude"`
+	MaxClimb         int64          `bson:"max_climb" json:"max_climb"`
+	TakeoffLat       float64        `bson:"takeoff_lat" json:"takeoff_lat"`
+	TakeoffLng       float64        `bson:"takeoff_lng" json:"takeoff_lng"`
+	TakeoffTime      time.Time      `bson:"takeoff_time" json:"takeoff_time"`
+	LandingLat       float64        `bson:"landing_lat" json:"landing_lat"`
+	LandingLng       float64        `bson:"landing_lng" json:"landing_lng"`
+	LandingTime      time.Time      `bson:"landing_time" json:"landing_time"`
+	Site             int            `bson:"site" json:"site"`
+	Pilot            string         `bson:"pilot" json:"pilot"`
+	PilotKey         string         `bson:"pilot_key" json:"-"`
+	Glider           string         `bson:"glider" json:"glider"`
+	GliderID         string         `bson:"glider_id" json:"glider_id"`
+	GliderIDKey      string         `bson:"glider_id_key" json:"-"`
+	GliderModel      string         `bson:"glider_model" json:"glider_model"`
+	GliderClass      string         `bson:"glider_class" json:"glider_class"`
+	CompetitionID    string         `bson:"competition_id" json:"competition_id"`
+	HDate            string         `bson:"h_date" json:"h_date"`
+	FlightDate       time.Time      `bson:"flight_date" json:"flight_date"`
+	URL              string         `bson:"track_src_url" json:"url"`
+	TimeStamp        string         `bson:"timestamp" json:"timestamp"`
+	Registered       time.Time      `bson:"registered" json:"registered"`
+	SignatureStatus  string         `bson:"signature_status" json:"signature_status"`
+	Clearance        *clearance     `bson:"clearance" json:"clearance"`
+	Infringements    []infringement `bson:"infringements" json:"infringements"`
+	AirspaceHash     string         `bson:"airspace_hash" json:"-"`
+}
+
+// newTrackInfo returns the stored summary of a parsed track, leaving the
+// registration details (id, source and timestamps) to the caller
+func newTrackInfo(track igc.Track) trackInfo {
+	// Calculate track length and highest altitude
+	points := track.Points
+	trackLength, trackLengthWGS84 := 0.0, 0.0
+	for i := 1; i < len(points); i++ {
+		trackLength += points[i-1].Distance(points[i])
+		trackLengthWGS84 += points[i-1].DistanceWGS84(points[i])
+	}
+	var maxGNSS, maxPressure int64
+	for _, p := range points {
+		if p.GNSSAltitude > maxGNSS {
+			maxGNSS = p.GNSSAltitude
+		}
+		if p.PressureAltitude > maxPressure {
+			maxPressure = p.PressureAltitude
+		}
+	}
+	maxAltitude := maxGNSS
+	if maxAltitude == 0 { // no GNSS altitude recorded
+		maxAltitude = maxPressure
+	}
+
+	info := trackInfo{
+		TrackLength:      trackLength,
+		TrackLengthWGS84: trackLengthWGS84,
+		Score:            contestScore(points),
+		Airtime:          int64(track.Duration().Seconds()),
+		MaxAltitude:      maxAltitude,
+		MaxClimb:         maxClimb(points),
+		Pilot:            track.Pilot,
+		PilotKey:         normalizePilotName(track.Pilot),
+		Glider:           track.GliderType,
+		GliderID:         track.GliderID,
+		GliderIDKey:      normalizeWords(track.GliderID),
+		CompetitionID:    track.CompetitionID,
+		HDate:            track.Header.Date.String(),
+		FlightDate:       track.Header.Date,
+	}
+	if len(points) > 0 {
+		// Without detected flight, the logged fixes are taken as the flight
+		takeoff, landing, flying := detectFlight(points)
+		if !flying {
+			takeoff, landing = 0, len(points)-1
+		}
+		agl := terrain.aboveGround(points)
+		if flying {
+			landing = landOnGround(agl, takeoff, landing)
+		}
+		info.Clearance = flightClearance(points, agl, takeoff, landing)
+		info.TakeoffLat = points[takeoff].Lat.Degrees()
+		info.TakeoffLng = points[takeoff].Lng.Degrees()
+		info.TakeoffTime = points[takeoff].Time
+		info.LandingLat = points[landing].Lat.Degrees()
+		info.LandingLng = points[landing].Lng.Degrees()
+		info.LandingTime = points[landing].Time
+		if flying {
+			info.Airtime = int64(info.LandingTime.Sub(info.TakeoffTime).Seconds())
+		}
+	}
+	info.setGlider(gliders)
+	return info
 }
 
 func fmtDurationAsISO8601(duration time.Duration) string {
@@ -62,14 +156,26 @@ func (t trackInfo) getFieldByName(fieldName string) (string, bool) {
 		return t.Glider, true
 	case "glider_id":
 		return t.GliderID, true
+	case "glider_model":
+		return t.GliderModel, true
+	case "glider_class":
+		return t.GliderClass, true
+	case "competition_id":
+		return t.CompetitionID, true
 	case "H_date":
 		return t.HDate, true
 	case "calculated total track length":
 		return strconv.FormatFloat(t.TrackLength, 'f', 6, 64), true
+	case "track_length_wgs84":
+		return strconv.FormatFloat(t.TrackLengthWGS84, 'f', 6, 64), true
 	case "track_src_url":
 		return t.URL, true
 	case "timestamp":
 		return t.TimeStamp, true
+	case "signature_status":
+		return t.SignatureStatus, true
+	case "site":
+		return strconv.Itoa(t.Site), true
 	default:
 		return "", false
 	}
@@ -79,19 +185,33 @@ type TrackDB struct {
 	DatabaseURL    string `bson:"database_url"`
 	DatabaseName   string `bson:"database_name"`
 	CollectionName string `bson:"collection_name"`
+	session        *mgo.Session // dialed once by Init, copied for every use
 }
 
 func getCollection(db TrackDB) *mgo.Collection {
-	session, err := mgo.Dial(db.DatabaseURL)
-	if err != nil {
-		panic(err)
+	return getNamedCollection(db, db.CollectionName)
+}
+
+// getNamedCollection returns another collection of the track database, on
+// a copy of the session of the database. The caller closes it with
+// collection.Database.Session.Close().
+func getNamedCollection(db TrackDB, name string) *mgo.Collection {
+	session := db.session
+	if session == nil {
+		s, err := mgo.Dial(db.DatabaseURL)
+		if err != nil {
+			panic(err)
+		}
+		return s.DB(db.DatabaseName).C(name)
 	}
-	return session.DB(db.DatabaseName).C(db.CollectionName)
+	return session.Copy().DB(db.DatabaseName).C(name)
 }
 
 /// Count ... returns the amount of tracks stored
 func (db TrackDB) Count() int {
-	count, err := getCollection(db).Count()
+	collection := getCollection(db)
+	defer collection.Database.Session.Close()
+	count, err := collection.Count()
 	if err != nil {
 		panic(err)
 	}
@@ -100,42 +220,222 @@ func (db TrackDB) Count() int {
 
 func (db TrackDB) GetLatestTrack() trackInfo {
 	var latestTrack trackInfo
-	err := getCollection(db).Find(bson.M{"id": db.Count() - 1}).One(&latestTrack)
+	collection := getCollection(db)
+	defer collection.Database.Session.Close()
+	err := collection.Find(bson.M{}).Sort("-id").One(&latestTrack)
 	if err != nil {
 		panic(err)
 	}
 	return latestTrack
 }
 
+// NextID returns the id for a new track, one above the highest id in use
+func (db TrackDB) NextID() int {
+	var latestTrack trackInfo
+	collection := getCollection(db)
+	defer collection.Database.Session.Close()
+	err := collection.Find(bson.M{}).Sort("-id").One(&latestTrack)
+	if err == mgo.ErrNotFound {
+		return 0
+	}
+	if err != nil {
+		panic(err)
+	}
+	return latestTrack.ID + 1
+}
+
 // DeleteAllTracks ...deletes all tracks in the database
 func (db TrackDB) GetTrackByID(id int) trackInfo {
 	var track trackInfo
-	err := getCollection(db).Find(bson.M{"id": id}).One(&track)
+	collection := getCollection(db)
+	defer collection.Database.Session.Close()
+	err := collection.Find(bson.M{"id": id}).One(&track)
 	if err != nil {
 		panic(err)
 	}
 	return track
 }
 
-func (db TrackDB) Init() {
+// RegisterTrack stores a new track read from the given source, with its
+// statistics, launch site, airspace infringements and geometry.
+//
+// Tracks without a source URL are given their IGC content, kept in the
+// database to read them again.
+func (db TrackDB) RegisterTrack(track igc.Track, url string, signature igc.VerificationStatus, content string) trackInfo {
+	info := newTrackInfo(track)
+	info.ID = db.NextID()
+	now := time.Now()
+	info.TimeStamp = now.String()
+	info.Registered = now
+	info.URL = url
+	info.SignatureStatus = string(signature)
+	if len(track.Points) > 0 {
+		info.Site = db.assignSite(info.TakeoffLat, info.TakeoffLng)
+	}
+	info.Infringements, info.AirspaceHash = checkInfringements(track)
+	if content != "" {
+		files := getFileCollection(db)
+		defer files.Database.Session.Close()
+		_, err := files.Upsert(bson.M{"id": info.ID}, trackFile{info.ID, content})
+		if err != nil {
+			panic(err)
+		}
+	}
+	collection := getCollection(db)
+	defer collection.Database.Session.Close()
+	err := collection.Insert(info)
+	if err != nil {
+		panic(err)
+	}
+	db.SaveGeometry(newTrackGeometry(info.ID, track))
+	events.Publish("created", info)
+	return info
+}
+
+// Track formats read by conversion to IGC, by file extension
+var importFormats = map[string]func(io.Reader) (igc.Track, error){
+	".nmea": igc.ParseNMEA,
+	".fit":  igc.ParseFIT,
+}
+
+// ImportTrack registers a track read from another format than IGC, keeping
+// its IGC encoding as the content of the track
+func (db TrackDB) ImportTrack(track igc.Track, url string) (trackInfo, error) {
+	if len(track.Manufacturer) != 3 || len(track.UniqueID) != 3 {
+		// not from an IGC approved logger
+		track.Manufacturer, track.UniqueID = "XXX", "000"
+	}
+	content, err := igc.EncodeString(track)
+	if err != nil {
+		return trackInfo{}, err
+	}
+	// Read back, so that the statistics are those of the stored fixes
+	track, err = igc.Parse(content)
+	if err != nil {
+		return trackInfo{}, err
+	}
+	return db.RegisterTrack(track, url, igc.StatusUnsigned, content), nil
+}
+
+// trackFile is the IGC content of a track without a source URL
+type trackFile struct {
+	ID      int    `bson:"id"`
+	Content string `bson:"content"`
+}
+
+func getFileCollection(db TrackDB) *mgo.Collection {
+	return getNamedCollection(db, db.CollectionName+"Files")
+}
+
+// trackClient downloads the stored tracks read again
+var trackClient = &http.Client{Timeout: 30 * time.Second}
+
+// trackSourceError is the HTTP status of a source URL not returning its
+// track
+type trackSourceError int
+
+func (e trackSourceError) Error() string {
+	return fmt.Sprintf("track source answered %v %v", int(e), http.StatusText(int(e)))
+}
+
+// LoadTrack reads a stored track again, from its IGC content if it is kept
+// in the database and from its source URL otherwise
+func (db TrackDB) LoadTrack(info trackInfo) (igc.Track, error) {
+	var file trackFile
+	files := getFileCollection(db)
+	defer files.Database.Session.Close()
+	err := files.Find(bson.M{"id": info.ID}).One(&file)
+	if err == nil {
+		return igc.Parse(file.Content)
+	}
+	if err != mgo.ErrNotFound {
+		panic(err)
+	}
+	if !strings.HasPrefix(info.URL, "http") {
+		return igc.ParseLocation(info.URL)
+	}
+	resp, err := trackClient.Get(info.URL)
+	if err != nil {
+		return igc.Track{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return igc.Track{}, trackSourceError(resp.StatusCode)
+	}
+	return igc.ParseReader(resp.Body)
+}
+
+// LookupTrack returns the track with the given id, or false if there is none
+func (db TrackDB) LookupTrack(id int) (trackInfo, bool) {
+	var track trackInfo
+	collection := getCollection(db)
+	defer collection.Database.Session.Close()
+	err := collection.Find(bson.M{"id": id}).One(&track)
+	if err == mgo.ErrNotFound {
+		return track, false
+	}
+	if err != nil {
+		panic(err)
+	}
+	return track, true
+}
+
+// Init dials the database, the session being shared by every later use
+func (db *TrackDB) Init() {
 	session, err := mgo.Dial(db.DatabaseURL)
 	if err != nil {
 		panic(err)
 	}
-	defer session.Close()
+	db.session = session
 }
 func (db TrackDB) DeleteAllTracks() int {
-	numDeleted := db.Count()
+	var tracks []trackInfo
+	collection := getCollection(db)
+	defer collection.Database.Session.Close()
+	err := collection.Find(bson.M{}).Sort("id").All(&tracks)
+	if err != nil {
+		panic(err)
+	}
+	numDeleted := len(tracks)
 	if numDeleted == 0 {
 		return 0
 	}
-	_, err := getCollection(db).RemoveAll(bson.M{})
+	_, err = collection.RemoveAll(bson.M{})
+	if err != nil {
+		panic(err)
+	}
+	geometry := getGeometryCollection(db)
+	defer geometry.Database.Session.Close()
+	_, err = geometry.RemoveAll(bson.M{})
 	if err != nil {
 		panic(err)
 	}
+	sites := getSiteCollection(db)
+	defer sites.Database.Session.Close()
+	_, err = sites.RemoveAll(bson.M{})
+	if err != nil {
+		panic(err)
+	}
+	files := getFileCollection(db)
+	defer files.Database.Session.Close()
+	_, err = files.RemoveAll(bson.M{})
+	if err != nil {
+		panic(err)
+	}
+	for _, t := range tracks {
+		events.Publish("deleted", t)
+	}
 	return numDeleted
 }
 
+// logPanic logs the panic of a background task, which would otherwise stop
+// the service, as the gin recovery does for requests
+func logPanic(task string) {
+	if r := recover(); r != nil {
+		log.Println(task+":", r)
+	}
+}
+
 func main() {
 
 	db := TrackDB{
@@ -145,6 +445,67 @@ func main() {
 	}
 
 	db.Init()
+	db.EnsureIndexes()
+	db.backfillPilotKeys()
+	db.backfillGliderIDKeys()
+
+	// Canonical glider models, matched against the glider of every track
+	if registry := os.Getenv("GLIDER_REGISTRY"); registry != "" {
+		r, err := loadGliderRegistry(registry)
+		if err != nil {
+			panic(err)
+		}
+		gliders = r
+		db.applyGliderRegistry(gliders)
+	}
+
+	// Terrain elevations, from the SRTM .hgt tiles in DEM_DIR
+	if dir := os.Getenv("DEM_DIR"); dir != "" {
+		terrain = newTerrainModel(dir)
+	}
+
+	// Named waypoints the launch sites are named after
+	if waypoints := os.Getenv("SITE_WAYPOINTS"); waypoints != "" {
+		w, err := loadWaypoints(waypoints)
+		if err != nil {
+			panic(err)
+		}
+		siteWaypoints = w
+		db.applySiteNames(siteWaypoints)
+	}
+
+	// Airspaces the tracks are checked against, from the OpenAir files in
+	// AIRSPACE_DIR and those uploaded
+	if err := db.loadAirspaces(os.Getenv("AIRSPACE_DIR")); err != nil {
+		panic(err)
+	}
+	go db.recheckInfringements()
+
+	// Live sessions are stored as tracks after LIVE_TIMEOUT_MINUTES without fixes
+	liveMinutes := liveTimeout
+	if minutes := os.Getenv("LIVE_TIMEOUT_MINUTES"); minutes != "" {
+		m, err := strconv.Atoi(minutes)
+		if err != nil || m < 1 {
+			panic("invalid LIVE_TIMEOUT_MINUTES " + minutes)
+		}
+		liveMinutes = m
+	}
+	go db.closeInactiveSessions(time.Duration(liveMinutes) * time.Minute)
+
+	// Beacons of the registered FLARM and OGN devices, from the APRS-IS
+	// server in OGN_APRS_SERVER, eg. aprs.glidernet.org:14580
+	if server := os.Getenv("OGN_APRS_SERVER"); server != "" {
+		devices, err := loadDeviceRegistry(os.Getenv("OGN_DEVICES"))
+		if err != nil {
+			panic(err)
+		}
+		callsign := os.Getenv("OGN_APRS_CALLSIGN")
+		if callsign == "" {
+			callsign = "IGCVIEW"
+		}
+		client := aprsClient{Address: server, Callsign: callsign, Filter: os.Getenv("OGN_APRS_FILTER")}
+		go client.Run(newOGNReceiver(db, devices).Receive)
+	}
 
 	router := gin.Default()
 
@@ -174,6 +535,31 @@ func main() {
 			numDeleted := db.DeleteAllTracks()
 			c.String(http.StatusOK, strconv.Itoa(numDeleted))
 		})
+
+		// 		POST /admin/api/airspace/<name>
+		// What: adds or replaces an OpenAir airspace file, and checks every track against the new airspaces
+		// Request body: the OpenAir file
+		// Response type: text/plain
+		// Response code: 200 if everything is OK, 400 if the file is malformed.
+		// Response: count of the airspaces in the file
+		adminAPI.POST("/airspace/:name", func(c *gin.Context) {
+			body, err := ioutil.ReadAll(c.Request.Body)
+			if err != nil {
+				c.String(http.StatusBadRequest, err.Error())
+				return
+			}
+			count, err := db.SaveAirspaceFile(c.Param("name"), string(body))
+			if err != nil {
+				c.String(http.StatusBadRequest, err.Error())
+				return
+			}
+			if err := db.loadAirspaces(os.Getenv("AIRSPACE_DIR")); err != nil {
+				c.String(http.StatusBadRequest, err.Error())
+				return
+			}
+			go db.recheckInfringements()
+			c.String(http.StatusOK, strconv.Itoa(count))
+		})
 	}
 
 	api := router.Group("/paragliding/api")
@@ -207,12 +593,15 @@ func main() {
 				return
 			}
 
-			if filepath.Ext(url) != ".igc" {
+			ext := strings.ToLower(filepath.Ext(url))
+			parse, imported := importFormats[ext]
+			if ext != ".igc" && !imported {
 				c.JSON(http.StatusBadRequest, gin.H{"error": "not a .igc file"})
 				return
 			}
 
 			collection := getCollection(db)
+			defer collection.Database.Session.Close()
 
 			// Check if tracks already exists in database
 			var existingTrack trackInfo
@@ -222,46 +611,76 @@ func main() {
 				return
 			}
 
-			// Parse the track
-			track, err := igc.ParseLocation(url)
+			src, err := igc.OpenLocation(url)
 			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 				return
 			}
 
-			// Calculate track length
-			points := track.Points
-			trackLength := 0.0
-			for i := 1; i < len(points); i++ {
-				trackLength += points[i-1].Distance(points[i])
+			// Convert other formats to IGC
+			if imported {
+				track, err := parse(src)
+				src.Close()
+				if err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+				info, err := db.ImportTrack(track, url)
+				if err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+				c.JSON(http.StatusOK, gin.H{"id": info.ID})
+				return
 			}
 
-			// Add to database
-			id := db.Count()
-			err = collection.Insert(trackInfo{
-				ID:          id,
-				TrackLength: trackLength,
-				Pilot:       track.Pilot,
-				Glider:      track.GliderType,
-				GliderID:    track.GliderID,
-				HDate:       track.Header.Date.String(),
-				TimeStamp:   time.Now().String(),
-				URL:         url,
-			})
+			// Parse the track, checking its signature on the way
+			track, signatureStatus, err := igc.ParseReaderVerify(src)
+			src.Close()
 			if err != nil {
-				panic(err)
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
 			}
-			c.JSON(http.StatusOK, gin.H{"id": id})
+
+			// Add to database
+			info := db.RegisterTrack(track, url, signatureStatus, "")
+			c.JSON(http.StatusOK, gin.H{"id": info.ID})
 		})
 
 		// GET /api/track
-		// What: returns the array of all tracks ids
+		// What: returns the array of all tracks ids, or of the tracks matching the query
 		// Response type: application/json
-		// Response code: 200 if everything is OK, appropriate error code otherwise.
+		// Response code: 200 if everything is OK, 400 if the query is malformed.
 		// Response: the array of IDs, or an empty array if no tracks have been stored yet.
+		//  Optional query parameters:
+		//   pilot, glider, glider_id, competition_id: exact match
+		//   signature: G record status (valid, invalid, unsigned or unknown-manufacturer)
+		//   flight_from, flight_to, registered_from, registered_to: date or RFC 3339 time
+		//   min_length, max_length: calculated track length in km
+		//   sort: id, pilot, glider, flight_date, registered or length, prefixed with - for descending
+		//   limit, cursor: page size, and the X-Next-Cursor header of the previous page
+		//   view: ids (default) or summary, to return the track objects instead of IDs
 		api.GET("/track", func(c *gin.Context) {
-			ids := make([]int, db.Count())
-			for i := range ids {
-				ids[i] = i
+			query, err := parseTrackQuery(c)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+
+			tracks, next := db.FindTracks(query)
+			if next != "" {
+				c.Header("X-Next-Cursor", next)
+			}
+			if query.summary {
+				if tracks == nil {
+					tracks = []trackInfo{}
+				}
+				c.JSON(http.StatusOK, tracks)
+				return
+			}
+			ids := make([]int, len(tracks))
+			for i := range tracks {
+				ids[i] = tracks[i].ID
 			}
 			c.JSON(http.StatusOK, ids)
 		})
@@ -284,8 +703,13 @@ func main() {
 				"pilot":                         trackInfo.Pilot,
 				"glider":                        trackInfo.Glider,
 				"glider_id":                     trackInfo.GliderID,
+				"competition_id":                trackInfo.CompetitionID,
 				"calculated total track length": trackInfo.TrackLength,
+				"track_length_wgs84":            trackInfo.TrackLengthWGS84,
 				"track_src_url":                 trackInfo.URL,
+				"signature_status":              trackInfo.SignatureStatus,
+				"site":                          trackInfo.Site,
+				"infringements":                 trackInfo.Infringements,
 			})
 		})
 
@@ -303,6 +727,22 @@ func main() {
 			}
 
 			trackInfo := db.GetTrackByID(id)
+			if c.Param("field") == "task" {
+				// The declared task, as a SeeYou .cup file
+				track, err := db.LoadTrack(trackInfo)
+				if err != nil {
+					c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+					return
+				}
+				if taskRoute(track) == nil {
+					c.Status(http.StatusNotFound)
+					return
+				}
+				var b bytes.Buffer
+				writeCUP(&b, cupTaskFromIGC(track.Task))
+				c.Data(http.StatusOK, "text/plain; charset=utf-8", b.Bytes())
+				return
+			}
 			fieldRequested, fieldExists := trackInfo.getFieldByName(c.Param("field"))
 			if !fieldExists {
 				c.Status(http.StatusNotFound)
@@ -312,12 +752,777 @@ func main() {
 			c.String(http.StatusOK, fieldRequested)
 		})
 
+		// POST /api/track/<id>/verify
+		// What: checks a track against a task, the first one of the SeeYou .cup file sent, or the
+		//  declared task of the track if none is sent
+		// Request body: a .cup file with waypoints and a task section
+		// Response type: application/json
+		// Response code: 200 if everything is OK, 400 if the file is malformed or has no such task,
+		//  404 if the track is unknown or has no declared task.
+		// Response: the time every zone was reached, whether the task was completed, its distance
+		//  and the distance achieved, in km. Query parameters:
+		//   task: description or index of the task of the file
+		api.POST("/track/:id/verify", func(c *gin.Context) {
+			id, err := getAndValidateID(c)
+			if err != nil {
+				c.Status(http.StatusNotFound)
+				return
+			}
+			info, ok := db.LookupTrack(id)
+			if !ok {
+				c.Status(http.StatusNotFound)
+				return
+			}
+			track, err := db.LoadTrack(info)
+			if err != nil {
+				c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+				return
+			}
+			file, err := parseCUP(c.Request.Body)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			if len(file.Tasks) == 0 {
+				if taskRoute(track) == nil {
+					c.Status(http.StatusNotFound)
+					return
+				}
+				file = cupTaskFromIGC(track.Task)
+			}
+			task, ok := findCUPTask(file.Tasks, c.Query("task"))
+			if !ok {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "no such task"})
+				return
+			}
+			c.JSON(http.StatusOK, verifyTask(track, task))
+		})
+
+		// POST /api/track/<id>/badges
+		// What: checks whether a track qualifies for the legs of the FAI Silver, Gold and Diamond badges
+		// Request body: optional calibration table of the logger, [{"indicated": <m>, "true": <m>}, ...]
+		// Response type: application/json
+		// Response code: 200 if everything is OK, 400 if the calibration is malformed,
+		//  404 if the track is unknown, 502 if it could not be loaded.
+		// Response: the logger, declaration and declared course of the flight, and for every leg the
+		//  performance required and achieved, whether it qualifies, and the evidence fixes with their
+		//  recorded and calibrated altitudes
+		api.POST("/track/:id/badges", func(c *gin.Context) {
+			id, err := getAndValidateID(c)
+			if err != nil {
+				c.Status(http.StatusNotFound)
+				return
+			}
+			info, ok := db.LookupTrack(id)
+			if !ok {
+				c.Status(http.StatusNotFound)
+				return
+			}
+			body, err := ioutil.ReadAll(c.Request.Body)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			var cal calibration
+			if len(bytes.TrimSpace(body)) > 0 {
+				if err := json.Unmarshal(body, &cal); err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+			}
+			if err := cal.validate(); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			track, err := db.LoadTrack(info)
+			if err != nil {
+				c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusOK, checkBadges(info, track, cal))
+		})
+
+		// GET /api/geometry/<id>/<points|geojson|kml>
+		// What: returns the fixes of a given track, as JSON points, a GeoJSON feature or a KML document,
+		//  or NOT FOUND response code with an empty body.
+		// Response type: application/json, or application/vnd.google-earth.kml+xml for kml
+		// Response code: 200 if everything is OK, 400 if the resolution is malformed.
+		//  Optional query parameters:
+		//   resolution: tolerance in meters (eg. 50m), interval in seconds (eg. 30s) or number of fixes
+		//    (eg. 1000) to simplify the track to, keeping its timing, altitude peaks and contest route
+		api.GET("/geometry/:id/:format", func(c *gin.Context) {
+			id, err := getAndValidateID(c)
+			if err != nil {
+				c.Status(http.StatusNotFound)
+				return
+			}
+			format := c.Param("format")
+			if format != "points" && format != "geojson" && format != "kml" {
+				c.Status(http.StatusNotFound)
+				return
+			}
+			info, found := db.LookupTrack(id)
+			if !found {
+				c.Status(http.StatusNotFound)
+				return
+			}
+			track, err := db.LoadTrack(info)
+			if err != nil {
+				c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+				return
+			}
+			track, err = simplifyTrack(track, c.Query("resolution"))
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+
+			switch format {
+			case "points":
+				c.JSON(http.StatusOK, exportPoints(track))
+			case "geojson":
+				c.JSON(http.StatusOK, exportGeoJSON(info, track))
+			case "kml":
+				c.Data(http.StatusOK, "application/vnd.google-earth.kml+xml", exportKML(info, track))
+			}
+		})
+
+		// GET /api/pilots
+		// What: returns the flying statistics of every pilot, grouping the spelling variants of a name
+		// Response type: application/json
+		// Response code: 200 if everything is OK, appropriate error code otherwise.
+		// Response: an array of pilots with flight count, airtime (seconds), total and longest
+		//  distance (km), highest altitude (m) and gliders used, or an empty array.
+		api.GET("/pilots", func(c *gin.Context) {
+			c.JSON(http.StatusOK, db.GetPilots())
+		})
+
+		// GET /api/pilots/<name>
+		// What: returns the flying statistics of a given pilot, with a breakdown per month,
+		//  or NOT FOUND response code with an empty body. Any spelling variant of the name is accepted.
+		// Response type: application/json
+		// Response code: 200 if everything is OK, appropriate error code otherwise.
+		api.GET("/pilots/:name", func(c *gin.Context) {
+			pilot, found := db.GetPilot(c.Param("name"))
+			if !found {
+				c.Status(http.StatusNotFound)
+				return
+			}
+			c.JSON(http.StatusOK, pilot)
+		})
+
+		// GET /api/gliders
+		// What: returns every glider model of the registry, with the statistics of its flights
+		// Response type: application/json
+		// Response code: 200 if everything is OK, appropriate error code otherwise.
+		// Response: an array of models with manufacturer, certification class, handicap, flight
+		//  and pilot count, airtime (seconds), total and longest distance (km) and highest altitude (m).
+		api.GET("/gliders", func(c *gin.Context) {
+			c.JSON(http.StatusOK, db.GetGliders(gliders))
+		})
+
+		// GET /api/gliders/<model>
+		// What: returns a glider model of the registry with the statistics of its flights, and the
+		//  track ids flown by each of its registered glider ids, or NOT FOUND with an empty body.
+		// Response type: application/json
+		// Response code: 200 if everything is OK, appropriate error code otherwise.
+		api.GET("/gliders/:model", func(c *gin.Context) {
+			glider, found := db.GetGlider(gliders, c.Param("model"))
+			if !found {
+				c.Status(http.StatusNotFound)
+				return
+			}
+			c.JSON(http.StatusOK, glider)
+		})
+
+		// GET /api/leaderboard/<metric>
+		// What: ranks the pilots by distance (longest flight, km), score (best contest score),
+		//  airtime (total, seconds) or climb (highest height gain, m) over a period.
+		// Response type: application/json
+		// Response code: 200 if everything is OK, 400 if the query is malformed.
+		//  Optional query parameters:
+		//   period: day (date=YYYY-MM-DD), month (date=YYYY-MM), season (season=YYYY) or
+		//    custom (from, to), defaults to the current season
+		//   glider_class: only count flights in gliders of the class
+		//   region: minLat,minLng,maxLat,maxLng box the flights took off in
+		//   limit: number of pilots, defaults to 10
+		api.GET("/leaderboard/:metric", func(c *gin.Context) {
+			from, to, err := parsePeriod(c, time.Now())
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			filter := bson.M{}
+			if class := c.Query("glider_class"); class != "" {
+				filter["glider_class"] = class
+			}
+			if region := c.Query("region"); region != "" {
+				box, err := parseRegion(region)
+				if err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+				filter["takeoff_lat"] = bson.M{"$gte": box[0], "$lte": box[2]}
+				filter["takeoff_lng"] = bson.M{"$gte": box[1], "$lte": box[3]}
+			}
+			limit := leaderboardSize
+			if l := c.Query("limit"); l != "" {
+				if limit, err = strconv.Atoi(l); err != nil || limit < 1 {
+					c.JSON(http.StatusBadRequest, gin.H{"error": "invalid limit"})
+					return
+				}
+			}
+
+			board, err := db.GetLeaderboard(c.Param("metric"), from, to, filter, limit)
+			if err != nil {
+				c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusOK, board)
+		})
+
+		// GET /api/area/<bbox|radius|polygon>
+		// What: returns the ids of the tracks passing through an area
+		// Response type: application/json
+		// Response code: 200 if everything is OK, 400 if the area is malformed.
+		//  Query parameters, by kind of area:
+		//   bbox: box=minLat,minLng,maxLat,maxLng
+		//   radius: center=lat,lng and radius in km
+		//   polygon: polygon=lat,lng;lat,lng;lat,lng...
+		//   from, to: optional date or RFC 3339 time, only counting the fixes in between
+		api.GET("/area/:kind", func(c *gin.Context) {
+			area, err := parseArea(c, c.Param("kind"))
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			var from, to time.Time
+			if s := c.Query("from"); s != "" {
+				if from, err = parseTime(s); err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": "invalid from"})
+					return
+				}
+			}
+			if s := c.Query("to"); s != "" {
+				if to, err = parseTime(s); err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": "invalid to"})
+					return
+				}
+				if len(s) == len("2006-01-02") {
+					to = to.AddDate(0, 0, 1)
+				}
+			}
+			c.JSON(http.StatusOK, db.FindTracksInArea(area, from, to))
+		})
+
+		// GET /api/stream
+		// What: pushes an event for every registered (created), updated or deleted track
+		// Response type: text/event-stream
+		// Response code: 200
+		// Response: Server-Sent Events carrying the track summary. Clients resume after the
+		//  Last-Event-ID header, or lastEventId query parameter, from the latest 256 events, new
+		//  clients only receiving the events that follow.
+		api.GET("/stream", streamEvents)
+
+		// GET /api/compare
+		// What: replays several tracks together, aligned on absolute time, for comparing pilots on a task
+		// Response type: application/json
+		// Response code: 200 if everything is OK, 400 if the query is malformed or a track is unknown.
+		// Response: the pilots, the route, and frames at a common interval with the interpolated
+		//  position and altitude of every pilot, their distance to goal along the route, their
+		//  altitude and distance to goal deltas to the leader, and the leader of the frame.
+		//  Query parameters:
+		//   ids: comma separated track ids, 2 to 20
+		//   interval: seconds between frames, defaults to 10
+		//   goal: lat,lng of the goal, needed when the first tracks have no declared task
+		api.GET("/compare", func(c *gin.Context) {
+			ids, interval, goal, err := parseComparison(c)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			result, err := db.CompareTracks(ids, interval, goal)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusOK, result)
+		})
+
+		// GET /api/airspace
+		// What: returns the airspaces tracks are checked against
+		// Response type: application/json
+		// Response code: 200 if everything is OK, appropriate error code otherwise.
+		// Response: an array of airspaces with their name, class, floor, ceiling and source file.
+		api.GET("/airspace", func(c *gin.Context) {
+			airspaces.RLock()
+			list := append([]airspace{}, airspaces.list...)
+			airspaces.RUnlock()
+			c.JSON(http.StatusOK, list)
+		})
+
+		// GET /api/sites
+		// What: returns the launch sites, clustered from the takeoff locations of the tracks
+		// Response type: application/json
+		// Response code: 200 if everything is OK, appropriate error code otherwise.
+		// Response: an array of sites with their name, center, flight count, longest flights,
+		//  median takeoff time and middle half of the takeoff times (UTC), and takeoffs per hour.
+		api.GET("/sites", func(c *gin.Context) {
+			c.JSON(http.StatusOK, db.GetSites())
+		})
+
+		// POST /api/live
+		// What: opens a live tracking session
+		// Request body: {"pilot": "<pilot>", "glider": "<glider>", "glider_id": "<id>", "competition_id": "<id>"}
+		// Response type: application/json
+		// Response code: 200 if everything is OK, 400 if the body is malformed, 500 if the session
+		//  could not be stored.
+		// Response: {"session": "<session>", "token": "<token>"}, the token being needed to send fixes
+		api.POST("/live", func(c *gin.Context) {
+			// only the pilot and glider are taken from the client, the
+			// device being set by the OGN receiver alone
+			var body struct {
+				Pilot         string `json:"pilot"`
+				Glider        string `json:"glider"`
+				GliderID      string `json:"glider_id"`
+				CompetitionID string `json:"competition_id"`
+			}
+			if err := c.BindJSON(&body); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			s, err := db.OpenLiveSession(liveSession{
+				Pilot:         body.Pilot,
+				Glider:        body.Glider,
+				GliderID:      body.GliderID,
+				CompetitionID: body.CompetitionID,
+			})
+			if err != nil {
+				c.JSON(liveStatus(err), gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"session": s.ID, "token": s.Token})
+		})
+
+		// POST /api/live/<session>
+		// What: adds a batch of fixes to a live session
+		// Request header: X-Live-Token: <token>
+		// Request body: [{"time": "<RFC 3339>", "lat": <lat>, "lng": <lng>, "gnss_altitude": <m>, "pressure_altitude": <m>}, ...]
+		// Response type: application/json
+		// Response code: 200 if everything is OK, 400 if a fix is malformed, 403 if the token is wrong,
+		//  404 if the session is unknown, 409 if it is closed, 500 if the fixes could not be stored.
+		// Response: {"added": <count>}, fixes at or before the last one of the session being skipped
+		api.POST("/live/:session", func(c *gin.Context) {
+			var fixes []liveFix
+			if err := c.BindJSON(&fixes); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			added, err := db.AddLiveFixes(c.Param("session"), c.GetHeader("X-Live-Token"), fixes)
+			if err != nil {
+				c.JSON(liveStatus(err), gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"added": added})
+		})
+
+		// DELETE /api/live/<session>
+		// What: closes a live session, storing its fixes as a track
+		// Request header: X-Live-Token: <token>
+		// Response type: application/json
+		// Response code: 200 if everything is OK, 403 if the token is wrong, 404 if the session
+		//  is unknown, 409 if it is already closed or being closed, 500 if the track could not be
+		//  stored, the session then staying open.
+		// Response: {"id": <track id>}, the id being null for a session without fixes
+		api.DELETE("/live/:session", func(c *gin.Context) {
+			token := c.GetHeader("X-Live-Token")
+			if token == "" {
+				c.JSON(http.StatusForbidden, gin.H{"error": errLiveToken.Error()})
+				return
+			}
+			s, err := db.CloseLiveSession(c.Param("session"), token)
+			switch err {
+			case nil:
+				c.JSON(http.StatusOK, gin.H{"id": s.Track})
+			case errLiveNotFound, errLiveToken, errLiveClosed:
+				c.JSON(liveStatus(err), gin.H{"error": err.Error()})
+			default:
+				// still open, and stored by the next close
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			}
+		})
+
+		// GET /api/live
+		// What: returns the current position of every pilot followed live
+		// Response type: application/json
+		// Response code: 200 if everything is OK, appropriate error code otherwise.
+		// Response: an array of the open sessions with their pilot, glider and last fix
+		api.GET("/live", func(c *gin.Context) {
+			c.JSON(http.StatusOK, db.ActiveLiveSessions())
+		})
+
+		// GET /api/live/<session>
+		// What: returns the trail of a live session
+		// Response type: application/json
+		// Response code: 200 if everything is OK, 400 if since or the resolution is malformed, 404 if
+		//  the session is unknown.
+		// Response: the session with its fixes and the id of its track once closed. Optional query parameters:
+		//   since: only the fixes after this time (RFC 3339)
+		//   resolution: tolerance in meters (eg. 50m), interval in seconds (eg. 30s) or number of fixes
+		//    (eg. 1000) to simplify the trail to, as for /geometry
+		api.GET("/live/:session", func(c *gin.Context) {
+			var since time.Time
+			if s := c.Query("since"); s != "" {
+				var err error
+				if since, err = time.Parse(time.RFC3339, s); err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": "invalid since"})
+					return
+				}
+			}
+			s, ok := db.LiveSession(c.Param("session"), since)
+			if !ok {
+				c.Status(http.StatusNotFound)
+				return
+			}
+			fixes, err := simplifyLiveFixes(s.Fixes, c.Query("resolution"))
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			s.Fixes = fixes
+			c.JSON(http.StatusOK, s)
+		})
+
+		// POST /api/tasks
+		// What: stores a competition task, that tracks can then be scored against
+		// Request body: an XCTrack .xctsk task, or the XCTSK: payload of its QR code
+		// Response type: application/json
+		// Response code: 200 if everything is OK, 400 if the task is malformed.
+		// Response: the id of the task. Query parameters:
+		//  name: name of the task
+		api.POST("/tasks", func(c *gin.Context) {
+			body, err := ioutil.ReadAll(c.Request.Body)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			task, err := parseXCTask(body)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"id": db.SaveTask(c.Query("name"), task)})
+		})
+
+		// GET /api/tasks
+		// What: returns the stored tasks
+		// Response type: application/json
+		// Response code: 200 if everything is OK, appropriate error code otherwise.
+		// Response: an array of the tasks with their id, name, creation time and distances between the
+		//  turnpoint centers and along the optimized route, on the FAI sphere and the WGS84 ellipsoid
+		api.GET("/tasks", func(c *gin.Context) {
+			c.JSON(http.StatusOK, db.GetTasks())
+		})
+
+		// GET /api/tasks/<id>
+		// What: returns a stored task as an XCTrack .xctsk file
+		// Response type: application/json
+		// Response code: 200 if everything is OK, 404 if the task is unknown.
+		api.GET("/tasks/:id", func(c *gin.Context) {
+			id, err := getAndValidateID(c)
+			if err != nil {
+				c.Status(http.StatusNotFound)
+				return
+			}
+			t, ok := db.LookupTask(id)
+			if !ok {
+				c.Status(http.StatusNotFound)
+				return
+			}
+			c.JSON(http.StatusOK, t.Task)
+		})
+
+		// GET /api/tasks/<id>/qr
+		// What: returns the string to encode in a QR code to load a stored task in XCTrack
+		// Response type: text/plain
+		// Response code: 200 if everything is OK, 404 if the task is unknown.
+		api.GET("/tasks/:id/qr", func(c *gin.Context) {
+			id, err := getAndValidateID(c)
+			if err != nil {
+				c.Status(http.StatusNotFound)
+				return
+			}
+			t, ok := db.LookupTask(id)
+			if !ok {
+				c.Status(http.StatusNotFound)
+				return
+			}
+			c.String(http.StatusOK, t.Task.qrPayload())
+		})
+
+		// GET /api/tasks/<id>/score/<track>
+		// What: scores a track against a stored task
+		// Response type: application/json
+		// Response code: 200 if everything is OK, 404 if the task or the track is unknown.
+		// Response: the time every turnpoint was reached, the start and ESS times, whether the goal
+		//  was reached, the time on the speed section in seconds and the distance flown, in km
+		api.GET("/tasks/:id/score/:track", func(c *gin.Context) {
+			id, err := getAndValidateID(c)
+			if err != nil {
+				c.Status(http.StatusNotFound)
+				return
+			}
+			t, ok := db.LookupTask(id)
+			if !ok {
+				c.Status(http.StatusNotFound)
+				return
+			}
+			trackID, err := strconv.Atoi(c.Param("track"))
+			if err != nil {
+				c.Status(http.StatusNotFound)
+				return
+			}
+			info, ok := db.LookupTrack(trackID)
+			if !ok {
+				c.Status(http.StatusNotFound)
+				return
+			}
+			track, err := db.LoadTrack(info)
+			if err != nil {
+				c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+				return
+			}
+			score := t.Task.ScoreTrack(track)
+			score.Task, score.Track = t.ID, info.ID
+			c.JSON(http.StatusOK, score)
+		})
+
+		// POST /api/competitions
+		// What: creates a competition
+		// Request body: {"name": "<name>", "params": {"day_points": 1000, "nominal_launch": 0.96, "nominal_distance": <km>,
+		//  "nominal_time": <minutes>, "nominal_goal": 0.3, "minimum_distance": <km>, "arrival_points": false, "ess_not_goal": 0.8,
+		//  "earth_model": "WGS84"}},
+		//  missing parameters taking these defaults
+		// Response type: application/json
+		// Response code: 200 if everything is OK, 400 if the body is malformed.
+		// Response: {"id": <id>}
+		api.POST("/competitions", func(c *gin.Context) {
+			body := struct {
+				Name   string    `json:"name"`
+				Params gapParams `json:"params"`
+			}{Params: defaultGAPParams}
+			if err := c.BindJSON(&body); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			if m := body.Params.EarthModel; m != "WGS84" && m != "FAI_SPHERE" {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid earth_model"})
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"id": db.SaveCompetition(body.Name, body.Params)})
+		})
+
+		// GET /api/competitions
+		// What: returns the competitions
+		// Response type: application/json
+		// Response code: 200 if everything is OK, appropriate error code otherwise.
+		// Response: an array of the competitions with their id, name and scoring parameters
+		api.GET("/competitions", func(c *gin.Context) {
+			c.JSON(http.StatusOK, db.GetCompetitions())
+		})
+
+		// GET /api/competitions/<id>
+		// What: returns a competition with its tasks and their entries
+		// Response type: application/json
+		// Response code: 200 if everything is OK, 404 if the competition is unknown.
+		api.GET("/competitions/:id", func(c *gin.Context) {
+			id, err := getAndValidateID(c)
+			if err != nil {
+				c.Status(http.StatusNotFound)
+				return
+			}
+			comp, ok := db.LookupCompetition(id)
+			if !ok {
+				c.Status(http.StatusNotFound)
+				return
+			}
+			c.JSON(http.StatusOK, comp)
+		})
+
+		// POST /api/competitions/<id>/tasks
+		// What: adds a task to a competition
+		// Request body: an XCTrack .xctsk task or the XCTSK: payload of its QR code, or nothing to use the
+		//  stored task of the task query parameter
+		// Response type: application/json
+		// Response code: 200 if everything is OK, 400 if the task or a parameter is malformed,
+		//  404 if the competition or stored task is unknown.
+		// Response: {"task": <number>}. Query parameters:
+		//  day: day of the task, YYYY-MM-DD
+		//  name: name of the task
+		//  present: number of pilots at the takeoff, to judge the launch validity
+		//  task: id of a stored task
+		api.POST("/competitions/:id/tasks", func(c *gin.Context) {
+			id, err := getAndValidateID(c)
+			if err != nil {
+				c.Status(http.StatusNotFound)
+				return
+			}
+			if _, ok := db.LookupCompetition(id); !ok {
+				c.Status(http.StatusNotFound)
+				return
+			}
+			if _, err := time.Parse("2006-01-02", c.Query("day")); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid day"})
+				return
+			}
+			present, err := strconv.Atoi(c.DefaultQuery("present", "0"))
+			if err != nil || present < 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid present"})
+				return
+			}
+			var x xcTask
+			if s := c.Query("task"); s != "" {
+				taskID, err := strconv.Atoi(s)
+				if err != nil {
+					c.Status(http.StatusNotFound)
+					return
+				}
+				stored, ok := db.LookupTask(taskID)
+				if !ok {
+					c.Status(http.StatusNotFound)
+					return
+				}
+				x = stored.Task
+			} else {
+				body, err := ioutil.ReadAll(c.Request.Body)
+				if err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+				if x, err = parseXCTask(body); err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+			}
+			task, err := compTaskFromXC(x)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			task.Day, task.Name, task.Present = c.Query("day"), c.Query("name"), present
+			c.JSON(http.StatusOK, gin.H{"task": db.AddCompetitionTask(id, task)})
+		})
+
+		// GET /api/competitions/<id>/tasks/<task>
+		// What: returns a task of a competition as an XCTrack .xctsk file
+		// Response type: application/json
+		// Response code: 200 if everything is OK, 404 if the competition or task is unknown.
+		api.GET("/competitions/:id/tasks/:task", func(c *gin.Context) {
+			comp, number, ok := db.lookupCompetitionTask(c)
+			if !ok {
+				c.Status(http.StatusNotFound)
+				return
+			}
+			c.JSON(http.StatusOK, comp.Tasks[number-1].xc())
+		})
+
+		// POST /api/competitions/<id>/tasks/<task>/entries
+		// What: submits the track of a pilot to a task, replacing the earlier one of the pilot
+		// Request body: {"track": <track id>}
+		// Response type: application/json
+		// Response code: 200 if everything is OK, 400 if the track was not flown on the day of the task,
+		//  404 if the competition, task or track is unknown.
+		api.POST("/competitions/:id/tasks/:task/entries", func(c *gin.Context) {
+			comp, number, ok := db.lookupCompetitionTask(c)
+			if !ok {
+				c.Status(http.StatusNotFound)
+				return
+			}
+			var body struct {
+				Track int `json:"track"`
+			}
+			if err := c.BindJSON(&body); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			info, ok := db.LookupTrack(body.Track)
+			if !ok {
+				c.Status(http.StatusNotFound)
+				return
+			}
+			switch err := db.SubmitEntry(comp.ID, number, info); err {
+			case nil:
+				c.JSON(http.StatusOK, gin.H{"track": info.ID})
+			case errCompNotFound:
+				c.Status(http.StatusNotFound)
+			default:
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			}
+		})
+
+		// GET /api/competitions/<id>/tasks/<task>/results
+		// What: scores the entries of a task with the GAP formula of the competition
+		// Response type: application/json
+		// Response code: 200 if everything is OK, 404 if the competition or task is unknown,
+		//  502 if a track could not be loaded.
+		// Response: the optimized task and speed section distances, the validities and quality of the day,
+		//  the weights of the points and, for every pilot by rank, the distance made, start and ESS times,
+		//  time on the speed section, arrival order, leading coefficient and points
+		api.GET("/competitions/:id/tasks/:task/results", func(c *gin.Context) {
+			comp, number, ok := db.lookupCompetitionTask(c)
+			if !ok {
+				c.Status(http.StatusNotFound)
+				return
+			}
+			result, err := db.TaskResult(comp, number)
+			if err != nil {
+				c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusOK, result)
+		})
+
+		// GET /api/competitions/<id>/results
+		// What: returns the overall results of a competition, or those of a single day
+		// Response type: application/json
+		// Response code: 200 if everything is OK, 404 if the competition is unknown,
+		//  502 if a track could not be loaded.
+		// Response: every pilot by rank, with the total points and the points of every day and task.
+		//  Query parameters:
+		//   day: only count the tasks of this day, YYYY-MM-DD
+		api.GET("/competitions/:id/results", func(c *gin.Context) {
+			id, err := getAndValidateID(c)
+			if err != nil {
+				c.Status(http.StatusNotFound)
+				return
+			}
+			comp, ok := db.LookupCompetition(id)
+			if !ok {
+				c.Status(http.StatusNotFound)
+				return
+			}
+			var results []compTaskResult
+			for _, task := range comp.Tasks {
+				if day := c.Query("day"); day != "" && task.Day != day {
+					continue
+				}
+				result, err := db.TaskResult(comp, task.Number)
+				if err != nil {
+					c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+					return
+				}
+				results = append(results, result)
+			}
+			c.JSON(http.StatusOK, overallResults(results))
+		})
+
 		// GET /api/ticker/
 		// What: returns the JSON struct representing the ticker for the IGC tracks. The first track returned should be the oldest. The array of track ids returned should be capped at 5, to emulate "paging" of the responses. The cap (5) should be a configuration parameter of the application (ie. easy to change by the administrator).
 		// Response type: application/json
 		// Response code: 200 if everything is OK, appropriate error code otherwise.
 		api.GET("/ticker", func(c *gin.Context) {
 			collection := getCollection(db)
+			defer collection.Database.Session.Close()
 			processingTimeStart := time.Now()
 			var tracks []trackInfo
 			err := collection.Find(bson.M{}).All(&tracks)
@@ -346,6 +1551,7 @@ func main() {
 
 		api.GET("/ticker/:param", func(c *gin.Context) {
 			collection := getCollection(db)
+			defer collection.Database.Session.Close()
 			param := c.Param("param")
 			switch param {
 			case "latest":
@@ -407,5 +1613,9 @@ func main() {
 		port = "8080"
 	}
 
+	// Profiles, leaderboards, sites and area searches need what tracks
+	// stored before them miss, filled in while the service runs
+	go db.backfillTracks("airtime", "max_altitude", "score", "max_climb", "flight_date", "track_length_wgs84")
+
 	router.Run(":" + port)
 }
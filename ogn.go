@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Read-only login of the APRS-IS servers
+	aprsPasscode = -1
+	// Time between keep-alive lines sent to the server
+	aprsKeepAlive = 4 * time.Minute
+	// Time without any line, including the server keep-alives, after which
+	// the connection is taken as lost
+	aprsReadTimeout = 2 * time.Minute
+	// Time before connecting again after a lost connection
+	aprsRetry = 30 * time.Second
+)
+
+// ognDevice is a FLARM or OGN tracker of the device registry, flown by a
+// pilot
+type ognDevice struct {
+	ID            string
+	Pilot         string
+	Glider        string
+	GliderID      string
+	CompetitionID string
+}
+
+// ognBeacon is an aircraft position of the OGN APRS feed
+type ognBeacon struct {
+	Callsign string
+	Device   string // 6 hex digits, upper case
+	Time     time.Time
+	Lat      float64
+	Lng      float64
+	Altitude int64   // m
+	Climb    float64 // m/s
+	NoTrack  bool    // the owner asked not to be tracked
+}
+
+var (
+	ognPosition  = regexp.MustCompile(`^([^>]+)>[^:]*:[/@](\d{6})h(\d{2})(\d{2}\.\d{2})([NS]).(\d{3})(\d{2}\.\d{2})([EW]).(?:\d{3}/\d{3})?/A=(-\d{5}|\d{6})(.*)$`)
+	ognPrecision = regexp.MustCompile(`!W(\d)(\d)!`)
+	ognID        = regexp.MustCompile(`\bid([0-9A-Fa-f]{2})([0-9A-Fa-f]{6})\b`)
+	ognClimb     = regexp.MustCompile(`([+-]\d+)fpm\b`)
+)
+
+// parseOGNBeacon reads an aircraft beacon of the APRS feed, with the date
+// of its UTC time of day taken as the nearest to now. Other lines, eg.
+// receiver beacons and server comments, are returned as false.
+func parseOGNBeacon(line string, now time.Time) (ognBeacon, bool) {
+	m := ognPosition.FindStringSubmatch(line)
+	if m == nil {
+		return ognBeacon{}, false
+	}
+	id := ognID.FindStringSubmatch(m[10])
+	if id == nil {
+		return ognBeacon{}, false
+	}
+	b := ognBeacon{Callsign: m[1], Device: strings.ToUpper(id[2])}
+	flags, _ := strconv.ParseUint(id[1], 16, 8)
+	b.NoTrack = flags&0x40 != 0 || flags&0x80 != 0
+
+	t, err := time.Parse("150405", m[2])
+	if err != nil {
+		return ognBeacon{}, false
+	}
+	now = now.UTC()
+	b.Time = time.Date(now.Year(), now.Month(), now.Day(), t.Hour(), t.Minute(), t.Second(), 0, time.UTC)
+	if b.Time.Sub(now) > 12*time.Hour {
+		b.Time = b.Time.AddDate(0, 0, -1)
+	} else if now.Sub(b.Time) > 12*time.Hour {
+		b.Time = b.Time.AddDate(0, 0, 1)
+	}
+
+	// The precision enhancement adds a third decimal to the minutes
+	var latExtra, lngExtra float64
+	if p := ognPrecision.FindStringSubmatch(m[10]); p != nil {
+		latExtra = float64(p[1][0]-'0') / 1000
+		lngExtra = float64(p[2][0]-'0') / 1000
+	}
+	latDeg, _ := strconv.ParseFloat(m[3], 64)
+	latMin, _ := strconv.ParseFloat(m[4], 64)
+	b.Lat = latDeg + (latMin+latExtra)/60
+	if m[5] == "S" {
+		b.Lat = -b.Lat
+	}
+	lngDeg, _ := strconv.ParseFloat(m[6], 64)
+	lngMin, _ := strconv.ParseFloat(m[7], 64)
+	b.Lng = lngDeg + (lngMin+lngExtra)/60
+	if m[8] == "W" {
+		b.Lng = -b.Lng
+	}
+
+	ft, _ := strconv.ParseInt(m[9], 10, 64)
+	b.Altitude = int64(math.Round(float64(ft) * feet))
+	if c := ognClimb.FindStringSubmatch(m[10]); c != nil {
+		fpm, _ := strconv.ParseFloat(c[1], 64)
+		b.Climb = fpm * feet / 60
+	}
+	return b, true
+}
+
+// loadDeviceRegistry reads the pilots of the OGN devices from a CSV file,
+// with a device_id column and optional pilot, glider, glider_id and
+// competition_id columns
+func loadDeviceRegistry(path string) (map[string]ognDevice, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err != nil {
+		return nil, err
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	if _, ok := columns["device_id"]; !ok {
+		return nil, fmt.Errorf("missing column 'device_id'")
+	}
+	field := func(row []string, name string) string {
+		if i, ok := columns[name]; ok && i < len(row) {
+			return strings.TrimSpace(row[i])
+		}
+		return ""
+	}
+
+	devices := make(map[string]ognDevice)
+	for line := 2; ; line++ {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		d := ognDevice{
+			ID:            strings.ToUpper(field(row, "device_id")),
+			Pilot:         field(row, "pilot"),
+			Glider:        field(row, "glider"),
+			GliderID:      field(row, "glider_id"),
+			CompetitionID: field(row, "competition_id"),
+		}
+		if len(d.ID) != 6 {
+			return nil, fmt.Errorf("line %v: invalid device_id", line)
+		}
+		devices[d.ID] = d
+	}
+	return devices, nil
+}
+
+// aprsClient reads the lines of an APRS-IS server, eg.
+// aprs.glidernet.org:14580, connecting again whenever the connection is lost
+type aprsClient struct {
+	Address  string
+	Callsign string
+	Filter   string        // server side filter, eg. r/60.6/6.4/100
+	Retry    time.Duration // time before connecting again, aprsRetry if zero
+}
+
+// Run sends every line received from the server to handle, never returning
+func (c aprsClient) Run(handle func(line string)) {
+	retry := c.Retry
+	if retry == 0 {
+		retry = aprsRetry
+	}
+	for {
+		if err := c.read(handle); err != nil {
+			log.Println("aprs:", err)
+		}
+		time.Sleep(retry)
+	}
+}
+
+func (c aprsClient) read(handle func(line string)) error {
+	conn, err := net.Dial("tcp", c.Address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	login := fmt.Sprintf("user %v pass %v vers IGCInfoViewer 2.0", c.Callsign, aprsPasscode)
+	if c.Filter != "" {
+		login += " filter " + c.Filter
+	}
+	if _, err := io.WriteString(conn, login+"\r\n"); err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(aprsKeepAlive)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				io.WriteString(conn, "#keepalive\r\n")
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	scanner := bufio.NewScanner(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(aprsReadTimeout))
+		if !scanner.Scan() {
+			break
+		}
+		if line := scanner.Text(); line != "" && line[0] != '#' {
+			handle(line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return io.EOF
+}
+
+// ognReceiver feeds the beacons of the registered devices into live
+// sessions, stored as tracks once the device stops sending
+type ognReceiver struct {
+	db      TrackDB
+	devices map[string]ognDevice
+	mutex   sync.Mutex
+}
+
+func newOGNReceiver(db TrackDB, devices map[string]ognDevice) *ognReceiver {
+	return &ognReceiver{db: db, devices: devices}
+}
+
+// Receive adds a line of the APRS feed to the live session of its device,
+// opening one if needed. Errors are logged, so that the feed goes on.
+func (r *ognReceiver) Receive(line string) {
+	defer logPanic("ogn")
+	b, ok := parseOGNBeacon(line, time.Now())
+	if !ok || b.NoTrack {
+		return
+	}
+	device, ok := r.devices[b.Device]
+	if !ok {
+		return
+	}
+	fix := liveFix{
+		Time:         b.Time,
+		Lat:          b.Lat,
+		Lng:          b.Lng,
+		GNSSAltitude: b.Altitude,
+		Climb:        b.Climb,
+	}
+	if err := r.add(device, fix); err != nil {
+		log.Println("ogn:", device.ID, err)
+	}
+}
+
+// add appends a fix to the open session of a device, opening one if needed
+func (r *ognReceiver) add(device ognDevice, fix liveFix) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for attempt := 0; attempt < 2; attempt++ {
+		s, ok, err := r.db.deviceSession(device.ID)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			s, err = r.db.OpenLiveSession(liveSession{
+				Pilot:         device.Pilot,
+				Glider:        device.Glider,
+				GliderID:      device.GliderID,
+				CompetitionID: device.CompetitionID,
+				Device:        device.ID,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		_, err = r.db.AddLiveFixes(s.ID, s.Token, []liveFix{fix})
+		if err != errLiveClosed {
+			return err
+		}
+		// closed for inactivity meanwhile, the fix starts a new session
+	}
+	return errLiveClosed
+}
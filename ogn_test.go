@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Beacons sent by the test server, one batch per connection
+var ognTestBeacons = [][]string{
+	{
+		"# aprsc 2.1.4-g408ed49",
+		"FLRDDA5BA>APRS,qAS,LFMX:/160829h4415.41N/00600.03E'342/049/A=005524 id0ADDA5BA -454fpm -1.1rot 8.8dB 0e +51.2kHz gps4x5",
+		"OGN123456>OGFLR,qAS,Letzi:/074548h4821.61S\\00923.05W^000/000/A=-00010 !W52! id06123456 +198fpm +0.0rot",
+		"LFMX>APRS,TCPIP*,qAC,GLIDERN1:/160830h4414.95NI00600.68E&/A=001611 v0.2.7.RPI-GPU CPU:0.7",
+	},
+	{
+		"FLRDDA5BA>APRS,qAS,LFMX:/160831h4415.42N/00600.04E'342/049/A=005531 !W00! id0ADDA5BA +0fpm -1.1rot",
+	},
+}
+
+func TestParseOGNBeacon(t *testing.T) {
+	now := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+	for _, test := range []struct {
+		line string
+		ok   bool
+		want ognBeacon
+	}{
+		{
+			line: ognTestBeacons[0][1],
+			ok:   true,
+			want: ognBeacon{
+				Callsign: "FLRDDA5BA",
+				Device:   "DDA5BA",
+				Time:     time.Date(2018, 6, 1, 16, 8, 29, 0, time.UTC),
+				Lat:      44 + 15.41/60,
+				Lng:      6 + 0.03/60,
+				Altitude: 1684,
+				Climb:    -454 * feet / 60,
+			},
+		},
+		{
+			line: ognTestBeacons[0][2],
+			ok:   true,
+			want: ognBeacon{
+				Callsign: "OGN123456",
+				Device:   "123456",
+				Time:     time.Date(2018, 6, 1, 7, 45, 48, 0, time.UTC),
+				Lat:      -(48 + 21.615/60),
+				Lng:      -(9 + 23.052/60),
+				Altitude: -3,
+				Climb:    198 * feet / 60,
+			},
+		},
+		{line: ognTestBeacons[0][3], ok: false},
+		{line: "FLRDDA5BA>APRS,qAS,LFMX:/160829h4415.41N/00600.03E'342/049/A=005524 id4ADDA5BA", ok: true,
+			want: ognBeacon{NoTrack: true}},
+	} {
+		b, ok := parseOGNBeacon(test.line, now)
+		if ok != test.ok {
+			t.Errorf("%v: got %v, want %v", test.line, ok, test.ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if test.want.NoTrack {
+			if !b.NoTrack {
+				t.Errorf("%v: not read as untracked", test.line)
+			}
+			continue
+		}
+		if b.Callsign != test.want.Callsign || b.Device != test.want.Device || !b.Time.Equal(test.want.Time) {
+			t.Errorf("%v: got %v %v at %v", test.line, b.Callsign, b.Device, b.Time)
+		}
+		if math.Abs(b.Lat-test.want.Lat) > 1e-9 || math.Abs(b.Lng-test.want.Lng) > 1e-9 {
+			t.Errorf("%v: got position %v %v, want %v %v", test.line, b.Lat, b.Lng, test.want.Lat, test.want.Lng)
+		}
+		if b.Altitude != test.want.Altitude {
+			t.Errorf("%v: got altitude %v, want %v", test.line, b.Altitude, test.want.Altitude)
+		}
+		if math.Abs(b.Climb-test.want.Climb) > 1e-9 {
+			t.Errorf("%v: got climb %v, want %v", test.line, b.Climb, test.want.Climb)
+		}
+		if b.NoTrack {
+			t.Errorf("%v: read as untracked", test.line)
+		}
+	}
+}
+
+// TestAPRSClient reads the beacons of a server dropping the connection
+// after each batch, checking that the client logs in again
+func TestAPRSClient(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	logins := make(chan string, len(ognTestBeacons))
+	go func() {
+		for _, batch := range ognTestBeacons {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			login, _ := bufio.NewReader(conn).ReadString('\n')
+			logins <- login
+			for _, line := range batch {
+				fmt.Fprintf(conn, "%v\r\n", line)
+			}
+			conn.Close()
+		}
+	}()
+
+	lines := make(chan string, 10)
+	client := aprsClient{
+		Address:  listener.Addr().String(),
+		Callsign: "TEST",
+		Filter:   "r/44.2/6.0/50",
+		Retry:    10 * time.Millisecond,
+	}
+	go client.Run(func(line string) { lines <- line })
+
+	var received []string
+	timeout := time.After(5 * time.Second)
+	for len(received) < 4 {
+		select {
+		case line := <-lines:
+			received = append(received, line)
+		case <-timeout:
+			t.Fatalf("got %v lines before the timeout: %v", len(received), received)
+		}
+	}
+
+	// server comments are left out
+	want := append(append([]string{}, ognTestBeacons[0][1:]...), ognTestBeacons[1]...)
+	for i := range want {
+		if received[i] != want[i] {
+			t.Errorf("line %v: got %q, want %q", i, received[i], want[i])
+		}
+	}
+	for i := 0; i < len(ognTestBeacons); i++ {
+		login := <-logins
+		if !strings.HasPrefix(login, "user TEST pass -1 ") || !strings.HasSuffix(login, " filter r/44.2/6.0/50\r\n") {
+			t.Errorf("connection %v: got login %q", i, login)
+		}
+	}
+
+	now := time.Date(2018, 6, 1, 16, 10, 0, 0, time.UTC)
+	b, ok := parseOGNBeacon(received[3], now)
+	if !ok || b.Device != "DDA5BA" || b.Altitude != 1686 || b.Climb != 0 {
+		t.Errorf("got beacon %+v after the reconnect", b)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// Letters folded to plain ASCII when normalizing names
+var nameFolder = strings.NewReplacer(
+	"æ", "ae", "ø", "o", "å", "a", "ä", "a", "ö", "o", "ü", "u", "ß", "ss",
+	"é", "e", "è", "e", "ê", "e", "á", "a", "à", "a", "â", "a", "í", "i",
+	"ó", "o", "ò", "o", "ô", "o", "ú", "u", "ñ", "n", "ç", "c", "č", "c",
+	"š", "s", "ž", "z", "ł", "l",
+)
+
+// normalizePilotName returns the key grouping the spelling variants of a
+// pilot name, as written by different loggers.
+//
+// Case, accents, punctuation and spacing are ignored, and "Last, First" is
+// read as "First Last", so "Doe, JOHN" and "john_doe" give "john doe".
+func normalizePilotName(name string) string {
+	if parts := strings.SplitN(name, ",", 2); len(parts) == 2 {
+		name = parts[1] + " " + parts[0]
+	}
+	return normalizeWords(name)
+}
+
+// normalizeWords returns s in lower case plain ASCII letters and digits,
+// with any run of other characters replaced by a single space.
+func normalizeWords(s string) string {
+	s = nameFolder.Replace(strings.ToLower(s))
+	words := strings.FieldsFunc(s, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	return strings.Join(words, " ")
+}
+
+type pilotMonth struct {
+	Month           string  `bson:"_id" json:"month"`
+	Flights         int     `bson:"flights" json:"flights"`
+	Airtime         int64   `bson:"airtime" json:"airtime"`
+	TotalDistance   float64 `bson:"total_distance" json:"total_distance"`
+	LongestDistance float64 `bson:"longest_distance" json:"longest_distance"`
+	HighestAltitude int64   `bson:"highest_altitude" json:"highest_altitude"`
+}
+
+type pilotStats struct {
+	Key             string       `bson:"_id" json:"key"`
+	Name            string       `bson:"name" json:"name"`
+	Names           []string     `bson:"names" json:"names"`
+	Flights         int          `bson:"flights" json:"flights"`
+	Airtime         int64        `bson:"airtime" json:"airtime"`
+	TotalDistance   float64      `bson:"total_distance" json:"total_distance"`
+	LongestDistance float64      `bson:"longest_distance" json:"longest_distance"`
+	HighestAltitude int64        `bson:"highest_altitude" json:"highest_altitude"`
+	Gliders         []string     `bson:"gliders" json:"gliders"`
+	Months          []pilotMonth `bson:"-" json:"months,omitempty"`
+}
+
+// pilotGroup returns the $group stage summing up the tracks by the given key
+func pilotGroup(key interface{}) bson.M {
+	return bson.M{"$group": bson.M{
+		"_id":              key,
+		"name":             bson.M{"$last": "$pilot"},
+		"names":            bson.M{"$addToSet": "$pilot"},
+		"flights":          bson.M{"$sum": 1},
+		"airtime":          bson.M{"$sum": "$airtime"},
+		"total_distance":   bson.M{"$sum": "$calculated total track length"},
+		"longest_distance": bson.M{"$max": "$calculated total track length"},
+		"highest_altitude": bson.M{"$max": "$max_altitude"},
+		"gliders":          bson.M{"$addToSet": "$glider"},
+	}}
+}
+
+// GetPilots returns the statistics of every pilot, ordered by key
+func (db TrackDB) GetPilots() []pilotStats {
+	pilots := []pilotStats{}
+	collection := getCollection(db)
+	defer collection.Database.Session.Close()
+	err := collection.Pipe([]bson.M{
+		{"$match": bson.M{"pilot_key": bson.M{"$ne": ""}}},
+		{"$sort": bson.M{"id": 1}},
+		pilotGroup("$pilot_key"),
+		{"$sort": bson.M{"_id": 1}},
+	}).All(&pilots)
+	if err != nil {
+		panic(err)
+	}
+	for i := range pilots {
+		sort.Strings(pilots[i].Names)
+		sort.Strings(pilots[i].Gliders)
+	}
+	return pilots
+}
+
+// GetPilot returns the statistics of the pilot with the given name, in any
+// of its spellings, with a breakdown per month of flight.
+func (db TrackDB) GetPilot(name string) (pilotStats, bool) {
+	key := normalizePilotName(name)
+	collection := getCollection(db)
+	defer collection.Database.Session.Close()
+
+	var pilot pilotStats
+	err := collection.Pipe([]bson.M{
+		{"$match": bson.M{"pilot_key": key}},
+		{"$sort": bson.M{"id": 1}},
+		pilotGroup("$pilot_key"),
+	}).One(&pilot)
+	if err == mgo.ErrNotFound || key == "" {
+		return pilot, false
+	}
+	if err != nil {
+		panic(err)
+	}
+	sort.Strings(pilot.Names)
+	sort.Strings(pilot.Gliders)
+
+	err = collection.Pipe([]bson.M{
+		{"$match": bson.M{"pilot_key": key}},
+		pilotGroup(bson.M{"$dateToString": bson.M{"format": "%Y-%m", "date": "$flight_date"}}),
+		{"$sort": bson.M{"_id": 1}},
+	}).All(&pilot.Months)
+	if err != nil {
+		panic(err)
+	}
+	return pilot, true
+}
+
+// backfillPilotKeys sets the pilot key of tracks stored before it existed
+func (db TrackDB) backfillPilotKeys() {
+	collection := getCollection(db)
+	defer collection.Database.Session.Close()
+	var tracks []trackInfo
+	err := collection.Find(bson.M{"pilot_key": bson.M{"$exists": false}}).All(&tracks)
+	if err != nil {
+		panic(err)
+	}
+	for _, t := range tracks {
+		err := collection.Update(bson.M{"id": t.ID}, bson.M{"$set": bson.M{"pilot_key": normalizePilotName(t.Pilot)}})
+		if err != nil {
+			panic(err)
+		}
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// Fields of trackInfo a track query can be sorted by, by query parameter value
+var trackSortFields = map[string]string{
+	"id":          "id",
+	"pilot":       "pilot",
+	"glider":      "glider",
+	"flight_date": "flight_date",
+	"registered":  "registered",
+	"length":      "calculated total track length",
+}
+
+// Exact match filters of a track query, by query parameter name
+var trackMatchFields = map[string]string{
+	"pilot":          "pilot",
+	"glider":         "glider",
+	"glider_id":      "glider_id",
+	"glider_model":   "glider_model",
+	"glider_class":   "glider_class",
+	"competition_id": "competition_id",
+	"signature":      "signature_status",
+}
+
+type trackQuery struct {
+	filter     bson.M
+	sortField  string
+	descending bool
+	limit      int
+	cursor     *trackCursor
+	summary    bool
+}
+
+// trackCursor marks the last track of a page, by its sort value and id
+type trackCursor struct {
+	Value interface{} `bson:"v"`
+	ID    int         `bson:"id"`
+}
+
+func (cur trackCursor) encode() string {
+	data, err := bson.Marshal(cur)
+	if err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeTrackCursor(s string) (*trackCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	var cur trackCursor
+	if err := bson.Unmarshal(data, &cur); err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	return &cur, nil
+}
+
+// parseTime accepts a date (2006-01-02) or a full RFC 3339 timestamp
+func parseTime(s string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// addTimeRange adds a from/to range on field to the filter, from query parameters <name>_from and <name>_to
+func addTimeRange(c *gin.Context, filter bson.M, name string, field string) error {
+	r := bson.M{}
+	if from := c.Query(name + "_from"); from != "" {
+		t, err := parseTime(from)
+		if err != nil {
+			return fmt.Errorf("invalid %v_from", name)
+		}
+		r["$gte"] = t
+	}
+	if to := c.Query(name + "_to"); to != "" {
+		t, err := parseTime(to)
+		if err != nil {
+			return fmt.Errorf("invalid %v_to", name)
+		}
+		// a plain date includes the whole day
+		if len(to) == len("2006-01-02") {
+			t = t.AddDate(0, 0, 1)
+		}
+		r["$lt"] = t
+	}
+	if len(r) > 0 {
+		filter[field] = r
+	}
+	return nil
+}
+
+func parseTrackQuery(c *gin.Context) (trackQuery, error) {
+	q := trackQuery{filter: bson.M{}, sortField: "id"}
+
+	for param, field := range trackMatchFields {
+		if value := c.Query(param); value != "" {
+			q.filter[field] = value
+		}
+	}
+	if err := addTimeRange(c, q.filter, "flight", "flight_date"); err != nil {
+		return q, err
+	}
+	if err := addTimeRange(c, q.filter, "registered", "registered"); err != nil {
+		return q, err
+	}
+
+	length := bson.M{}
+	if min := c.Query("min_length"); min != "" {
+		v, err := strconv.ParseFloat(min, 64)
+		if err != nil {
+			return q, fmt.Errorf("invalid min_length")
+		}
+		length["$gte"] = v
+	}
+	if max := c.Query("max_length"); max != "" {
+		v, err := strconv.ParseFloat(max, 64)
+		if err != nil {
+			return q, fmt.Errorf("invalid max_length")
+		}
+		length["$lte"] = v
+	}
+	if len(length) > 0 {
+		q.filter["calculated total track length"] = length
+	}
+
+	if sort := c.Query("sort"); sort != "" {
+		q.descending = strings.HasPrefix(sort, "-")
+		field, ok := trackSortFields[strings.TrimPrefix(sort, "-")]
+		if !ok {
+			return q, fmt.Errorf("invalid sort '%v'", sort)
+		}
+		q.sortField = field
+	}
+
+	if limit := c.Query("limit"); limit != "" {
+		v, err := strconv.Atoi(limit)
+		if err != nil || v < 1 {
+			return q, fmt.Errorf("invalid limit")
+		}
+		q.limit = v
+	}
+	if cursor := c.Query("cursor"); cursor != "" {
+		cur, err := decodeTrackCursor(cursor)
+		if err != nil {
+			return q, err
+		}
+		q.cursor = cur
+	}
+
+	switch c.DefaultQuery("view", "ids") {
+	case "ids":
+	case "summary":
+		q.summary = true
+	default:
+		return q, fmt.Errorf("invalid view '%v'", c.Query("view"))
+	}
+	return q, nil
+}
+
+// FindTracks returns the tracks matching the query, in the requested order,
+// and the cursor for the next page, or an empty string on the last page.
+func (db TrackDB) FindTracks(q trackQuery) ([]trackInfo, string) {
+	filter := q.filter
+	if q.cursor != nil {
+		op := "$gt"
+		if q.descending {
+			op = "$lt"
+		}
+		after := []bson.M{{"id": bson.M{op: q.cursor.ID}}}
+		if q.sortField != "id" {
+			after = []bson.M{
+				{q.sortField: bson.M{op: q.cursor.Value}},
+				{q.sortField: q.cursor.Value, "id": bson.M{op: q.cursor.ID}},
+			}
+		}
+		filter = bson.M{"$and": []bson.M{q.filter, {"$or": after}}}
+	}
+
+	sort := []string{q.sortField, "id"}
+	if q.descending {
+		sort = []string{"-" + q.sortField, "-id"}
+	}
+	if q.sortField == "id" {
+		sort = sort[:1]
+	}
+
+	collection := getCollection(db)
+	defer collection.Database.Session.Close()
+	query := collection.Find(filter).Sort(sort...)
+	if q.limit > 0 {
+		// one more than asked for tells if there is a next page
+		query = query.Limit(q.limit + 1)
+	}
+	var tracks []trackInfo
+	if err := query.All(&tracks); err != nil {
+		panic(err)
+	}
+
+	next := ""
+	if q.limit > 0 && len(tracks) > q.limit {
+		tracks = tracks[:q.limit]
+		last := tracks[len(tracks)-1]
+		next = trackCursor{Value: last.sortValue(q.sortField), ID: last.ID}.encode()
+	}
+	return tracks, next
+}
+
+func (t trackInfo) sortValue(field string) interface{} {
+	switch field {
+	case "pilot":
+		return t.Pilot
+	case "glider":
+		return t.Glider
+	case "flight_date":
+		return t.FlightDate
+	case "registered":
+		return t.Registered
+	case "calculated total track length":
+		return t.TrackLength
+	default:
+		return t.ID
+	}
+}
+
+// EnsureIndexes creates the indexes backing track lookups and queries
+func (db TrackDB) EnsureIndexes() {
+	collection := getCollection(db)
+	defer collection.Database.Session.Close()
+	err := collection.EnsureIndex(mgo.Index{Key: []string{"id"}, Unique: true})
+	if err != nil {
+		panic(err)
+	}
+	// leaderboards match on the flight date first, then class or region
+	for _, key := range [][]string{
+		{"flight_date", "glider_class"},
+		{"flight_date", "takeoff_lat", "takeoff_lng"},
+	} {
+		if err := collection.EnsureIndex(mgo.Index{Key: key}); err != nil {
+			panic(err)
+		}
+	}
+	geometry := getGeometryCollection(db)
+	defer geometry.Database.Session.Close()
+	if err := geometry.EnsureIndex(mgo.Index{Key: []string{"id"}, Unique: true}); err != nil {
+		panic(err)
+	}
+	for _, key := range []string{"cells", "cell_terms"} {
+		if err := geometry.EnsureIndex(mgo.Index{Key: []string{key}}); err != nil {
+			panic(err)
+		}
+	}
+	sites := getSiteCollection(db)
+	defer sites.Database.Session.Close()
+	if err := sites.EnsureIndex(mgo.Index{Key: []string{"id"}, Unique: true}); err != nil {
+		panic(err)
+	}
+	files := getFileCollection(db)
+	defer files.Database.Session.Close()
+	live := getLiveCollection(db)
+	defer live.Database.Session.Close()
+	tasks := getTaskCollection(db)
+	defer tasks.Database.Session.Close()
+	competitions := getCompetitionCollection(db)
+	defer competitions.Database.Session.Close()
+	for _, c := range []*mgo.Collection{files, live, tasks, competitions} {
+		if err := c.EnsureIndex(mgo.Index{Key: []string{"id"}, Unique: true}); err != nil {
+			panic(err)
+		}
+	}
+	for _, key := range [][]string{{"closed", "last_update"}, {"device", "closed"}} {
+		if err := live.EnsureIndex(mgo.Index{Key: key}); err != nil {
+			panic(err)
+		}
+	}
+
+	for _, key := range []string{
+		"track_src_url",
+		"pilot",
+		"pilot_key",
+		"glider",
+		"glider_id",
+		"glider_id_key",
+		"glider_model",
+		"glider_class",
+		"competition_id",
+		"signature_status",
+		"site",
+		"flight_date",
+		"registered",
+		"calculated total track length",
+	} {
+		if err := collection.EnsureIndex(mgo.Index{Key: []string{key, "id"}}); err != nil {
+			panic(err)
+		}
+	}
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/golang/geo/s2"
+	"github.com/marni/goigc"
+)
+
+const (
+	// Takeoffs closer than siteRadius (km) to the center of a site launched from it
+	siteRadius = 0.5
+	// Longest flights listed for every site
+	siteBestFlights = 3
+)
+
+// site is a launch site, clustered from the takeoff locations of the
+// tracks. Its center is the mean of the takeoffs assigned to it.
+type site struct {
+	ID       int     `bson:"id" json:"id"`
+	Name     string  `bson:"name" json:"name"`
+	Lat      float64 `bson:"lat" json:"lat"`
+	Lng      float64 `bson:"lng" json:"lng"`
+	Takeoffs int     `bson:"takeoffs" json:"-"`
+}
+
+// waypoint is a named location sites are named after
+type waypoint struct {
+	Name string
+	Lat  float64
+	Lng  float64
+}
+
+// Named waypoints, read from SITE_WAYPOINTS
+var siteWaypoints []waypoint
+
+// siteMutex serializes the changes to the sites, that read them all before
+// writing, so that concurrent uploads from a new site do not both add it
+// under the same id
+var siteMutex sync.Mutex
+
+func getSiteCollection(db TrackDB) *mgo.Collection {
+	return getNamedCollection(db, db.CollectionName+"Sites")
+}
+
+// distanceKm returns the great circle distance between two locations in km
+func distanceKm(lat1, lng1, lat2, lng2 float64) float64 {
+	a := s2.LatLngFromDegrees(lat1, lng1)
+	b := s2.LatLngFromDegrees(lat2, lng2)
+	return a.Distance(b).Radians() * igc.EarthRadius
+}
+
+// loadWaypoints reads named waypoints from a SeeYou .cup file, or a CSV
+// file with a header row naming the columns name, lat and lng, in decimal
+// degrees.
+func loadWaypoints(path string) ([]waypoint, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	if strings.EqualFold(filepath.Ext(path), ".cup") {
+		cup, err := parseCUP(file)
+		if err != nil {
+			return nil, err
+		}
+		var waypoints []waypoint
+		for _, wp := range cup.Waypoints {
+			waypoints = append(waypoints, waypoint{Name: wp.Name, Lat: wp.Lat, Lng: wp.Lng})
+		}
+		return waypoints, nil
+	}
+
+	reader := csv.NewReader(file)
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err != nil {
+		return nil, err
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, name := range []string{"name", "lat", "lng"} {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("missing column '%v'", name)
+		}
+	}
+
+	var waypoints []waypoint
+	for line := 2; ; line++ {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		wp := waypoint{Name: strings.TrimSpace(row[columns["name"]])}
+		wp.Lat, err = strconv.ParseFloat(strings.TrimSpace(row[columns["lat"]]), 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %v: invalid lat", line)
+		}
+		wp.Lng, err = strconv.ParseFloat(strings.TrimSpace(row[columns["lng"]]), 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %v: invalid lng", line)
+		}
+		waypoints = append(waypoints, wp)
+	}
+	return waypoints, nil
+}
+
+// siteName returns the name of the nearest waypoint within siteRadius of
+// the location, or an empty string
+func siteName(waypoints []waypoint, lat float64, lng float64) string {
+	name, nearest := "", siteRadius
+	for _, wp := range waypoints {
+		if d := distanceKm(lat, lng, wp.Lat, wp.Lng); d <= nearest {
+			name, nearest = wp.Name, d
+		}
+	}
+	return name
+}
+
+// assignSite returns the id of the site a takeoff location belongs to,
+// moving the center of the nearest site within siteRadius towards it, or
+// adding a new site if there is none.
+func (db TrackDB) assignSite(lat float64, lng float64) int {
+	siteMutex.Lock()
+	defer siteMutex.Unlock()
+	collection := getSiteCollection(db)
+	defer collection.Database.Session.Close()
+	var sites []site
+	err := collection.Find(nil).All(&sites)
+	if err != nil {
+		panic(err)
+	}
+
+	nearest, nextID := -1, 1
+	for i, s := range sites {
+		if d := distanceKm(lat, lng, s.Lat, s.Lng); d <= siteRadius &&
+			(nearest < 0 || d < distanceKm(lat, lng, sites[nearest].Lat, sites[nearest].Lng)) {
+			nearest = i
+		}
+		if s.ID >= nextID {
+			nextID = s.ID + 1
+		}
+	}
+
+	if nearest < 0 {
+		s := site{ID: nextID, Name: siteName(siteWaypoints, lat, lng), Lat: lat, Lng: lng, Takeoffs: 1}
+		if err := collection.Insert(s); err != nil {
+			panic(err)
+		}
+		return s.ID
+	}
+
+	s := sites[nearest]
+	n := float64(s.Takeoffs)
+	s.Lat = (s.Lat*n + lat) / (n + 1)
+	s.Lng = (s.Lng*n + lng) / (n + 1)
+	s.Takeoffs++
+	if s.Name == "" {
+		s.Name = siteName(siteWaypoints, s.Lat, s.Lng)
+	}
+	if err := collection.Update(bson.M{"id": s.ID}, s); err != nil {
+		panic(err)
+	}
+	return s.ID
+}
+
+// applySiteNames names every site after the nearest waypoint, so they
+// follow changes to the waypoint file
+func (db TrackDB) applySiteNames(waypoints []waypoint) {
+	siteMutex.Lock()
+	defer siteMutex.Unlock()
+	collection := getSiteCollection(db)
+	defer collection.Database.Session.Close()
+	var sites []site
+	err := collection.Find(nil).All(&sites)
+	if err != nil {
+		panic(err)
+	}
+	for _, s := range sites {
+		name := siteName(waypoints, s.Lat, s.Lng)
+		if name == s.Name {
+			continue
+		}
+		if err := collection.Update(bson.M{"id": s.ID}, bson.M{"$set": bson.M{"name": name}}); err != nil {
+			panic(err)
+		}
+	}
+}
+
+type siteFlight struct {
+	ID       int     `json:"id"`
+	Pilot    string  `json:"pilot"`
+	Distance float64 `json:"distance"`
+	Score    float64 `json:"score"`
+}
+
+type siteStats struct {
+	site
+	Flights       int          `json:"flights"`
+	BestFlights   []siteFlight `json:"best_flights"`
+	TypicalLaunch string       `json:"typical_launch"`
+	LaunchWindow  []string     `json:"launch_window"`
+	LaunchHours   [24]int      `json:"launch_hours"`
+}
+
+// timeOfDay formats seconds since midnight as HH:MM
+func timeOfDay(seconds int) string {
+	return fmt.Sprintf("%02d:%02d", seconds/3600, seconds/60%60)
+}
+
+// GetSites returns every site with its flight count, longest flights and
+// launch times. The typical launch is the median takeoff time of day, and
+// the launch window spans the middle half of the takeoffs, all in UTC.
+func (db TrackDB) GetSites() []siteStats {
+	siteCollection := getSiteCollection(db)
+	defer siteCollection.Database.Session.Close()
+	var sites []site
+	err := siteCollection.Find(nil).Sort("id").All(&sites)
+	if err != nil {
+		panic(err)
+	}
+	var tracks []trackInfo
+	collection := getCollection(db)
+	defer collection.Database.Session.Close()
+	err = collection.Find(bson.M{"site": bson.M{"$gt": 0}}).Select(bson.M{
+		"id": 1, "site": 1, "pilot": 1, "calculated total track length": 1, "score": 1, "takeoff_time": 1,
+	}).All(&tracks)
+	if err != nil {
+		panic(err)
+	}
+	bySite := make(map[int][]trackInfo)
+	for _, t := range tracks {
+		bySite[t.Site] = append(bySite[t.Site], t)
+	}
+
+	result := make([]siteStats, len(sites))
+	for i, s := range sites {
+		flights := bySite[s.ID]
+		stats := siteStats{site: s, Flights: len(flights), BestFlights: []siteFlight{}, LaunchWindow: []string{}}
+
+		sort.Slice(flights, func(a, b int) bool {
+			if flights[a].TrackLength != flights[b].TrackLength {
+				return flights[a].TrackLength > flights[b].TrackLength
+			}
+			return flights[a].ID < flights[b].ID
+		})
+		for j := 0; j < len(flights) && j < siteBestFlights; j++ {
+			stats.BestFlights = append(stats.BestFlights, siteFlight{
+				ID:       flights[j].ID,
+				Pilot:    flights[j].Pilot,
+				Distance: flights[j].TrackLength,
+				Score:    flights[j].Score,
+			})
+		}
+
+		var launches []int
+		for _, t := range flights {
+			if t.TakeoffTime.IsZero() {
+				continue
+			}
+			takeoff := t.TakeoffTime.UTC()
+			launches = append(launches, int(takeoff.Sub(takeoff.Truncate(24*time.Hour)).Seconds()))
+			stats.LaunchHours[takeoff.Hour()]++
+		}
+		if len(launches) > 0 {
+			sort.Ints(launches)
+			stats.TypicalLaunch = timeOfDay(launches[len(launches)/2])
+			stats.LaunchWindow = []string{
+				timeOfDay(launches[len(launches)/4]),
+				timeOfDay(launches[len(launches)*3/4]),
+			}
+		}
+		result[i] = stats
+	}
+	return result
+}
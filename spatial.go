@@ -0,0 +1,272 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/golang/geo/s1"
+	"github.com/golang/geo/s2"
+	"github.com/marni/goigc"
+)
+
+const (
+	// Cell levels of the track and area coverings, from about 150 km down to 500 m
+	coverMinLevel = 6
+	coverMaxLevel = 14
+	coverMaxCells = 32
+	// Most fixes kept in the stored path of a track, used to confirm the cell matches
+	geometryVertices = 500
+)
+
+var coverer = &s2.RegionCoverer{MinLevel: coverMinLevel, MaxLevel: coverMaxLevel, MaxCells: coverMaxCells}
+
+type geometryFix struct {
+	Lat  float64   `bson:"lat"`
+	Lng  float64   `bson:"lng"`
+	Time time.Time `bson:"time"`
+}
+
+// trackGeometry is the spatial index entry of a track.
+//
+// Cells is the s2 covering of the track, and CellTerms holds those cells
+// and all their ancestors up to coverMinLevel, so an area intersects the
+// track if one of its covering cells is in CellTerms (it contains a track
+// cell) or one of its cells or their ancestors is in Cells (a track cell
+// contains it).
+type trackGeometry struct {
+	ID        int           `bson:"id"`
+	Cells     []string      `bson:"cells"`
+	CellTerms []string      `bson:"cell_terms"`
+	Path      []geometryFix `bson:"path"`
+}
+
+func getGeometryCollection(db TrackDB) *mgo.Collection {
+	return getNamedCollection(db, db.CollectionName+"Geometry")
+}
+
+// newTrackGeometry returns the spatial index entry of a track, simplified
+// to geometryVertices fixes
+func newTrackGeometry(id int, track igc.Track) trackGeometry {
+	g := trackGeometry{ID: id, Cells: []string{}, CellTerms: []string{}}
+	if len(track.Points) == 0 {
+		return g
+	}
+
+	simplified := track.SimplifyTo(geometryVertices)
+	latlngs := make([]s2.LatLng, len(simplified.Points))
+	for i, p := range simplified.Points {
+		latlngs[i] = p.LatLng
+		g.Path = append(g.Path, geometryFix{Lat: p.Lat.Degrees(), Lng: p.Lng.Degrees(), Time: p.Time})
+	}
+
+	terms := make(map[string]bool)
+	for _, cell := range coverer.Covering(s2.PolylineFromLatLngs(latlngs)) {
+		g.Cells = append(g.Cells, cell.ToToken())
+		for level := cell.Level(); level >= coverMinLevel; level-- {
+			terms[cell.Parent(level).ToToken()] = true
+		}
+	}
+	for term := range terms {
+		g.CellTerms = append(g.CellTerms, term)
+	}
+	sort.Strings(g.CellTerms)
+	return g
+}
+
+// SaveGeometry adds or replaces the spatial index entry of a track
+func (db TrackDB) SaveGeometry(g trackGeometry) {
+	geometry := getGeometryCollection(db)
+	defer geometry.Database.Session.Close()
+	_, err := geometry.Upsert(bson.M{"id": g.ID}, g)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// spatialArea is a region tracks can be searched in
+type spatialArea interface {
+	region() s2.Region
+	// intersects reports whether the path, in flight order, enters the area
+	intersects(path []s2.Point) bool
+}
+
+type boxArea struct {
+	rect s2.Rect
+}
+
+func (a boxArea) region() s2.Region { return a.rect }
+
+func (a boxArea) intersects(path []s2.Point) bool {
+	lo, hi := a.rect.Lo(), a.rect.Hi()
+	corners := []s2.LatLng{lo, s2.LatLng{Lat: lo.Lat, Lng: hi.Lng}, hi, s2.LatLng{Lat: hi.Lat, Lng: lo.Lng}}
+	boundary := make([]s2.Point, len(corners))
+	for i, c := range corners {
+		boundary[i] = s2.PointFromLatLng(c)
+	}
+	return anyVertex(path, a.rect.ContainsPoint) || crossesBoundary(path, boundary)
+}
+
+type radiusArea struct {
+	cap s2.Cap
+}
+
+func (a radiusArea) region() s2.Region { return a.cap }
+
+func (a radiusArea) intersects(path []s2.Point) bool {
+	center, radius := a.cap.Center(), a.cap.Radius()
+	if len(path) == 1 {
+		return path[0].Distance(center) <= radius
+	}
+	for i := 1; i < len(path); i++ {
+		if s2.DistanceFromSegment(center, path[i-1], path[i]) <= radius {
+			return true
+		}
+	}
+	return false
+}
+
+type polygonArea struct {
+	loop *s2.Loop
+}
+
+func (a polygonArea) region() s2.Region { return a.loop }
+
+func (a polygonArea) intersects(path []s2.Point) bool {
+	return anyVertex(path, a.loop.ContainsPoint) || crossesBoundary(path, a.loop.Vertices())
+}
+
+func anyVertex(path []s2.Point, contains func(s2.Point) bool) bool {
+	for _, p := range path {
+		if contains(p) {
+			return true
+		}
+	}
+	return false
+}
+
+// crossesBoundary reports whether an edge of the path crosses an edge of the closed boundary
+func crossesBoundary(path []s2.Point, boundary []s2.Point) bool {
+	for i := 1; i < len(path); i++ {
+		for j := range boundary {
+			a, b := boundary[j], boundary[(j+1)%len(boundary)]
+			if s2.CrossingSign(path[i-1], path[i], a, b) != s2.DoNotCross {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// FindTracksInArea returns the ids of the tracks entering the area, only
+// counting the fixes between from and to when they are not zero.
+//
+// Candidates are found through the cell index and confirmed against their
+// stored path, so no track is loaded from its source.
+func (db TrackDB) FindTracksInArea(area spatialArea, from time.Time, to time.Time) []int {
+	var covering, ancestors []string
+	for _, cell := range coverer.Covering(area.region()) {
+		covering = append(covering, cell.ToToken())
+		for level := cell.Level(); level >= coverMinLevel; level-- {
+			ancestors = append(ancestors, cell.Parent(level).ToToken())
+		}
+	}
+	if len(covering) == 0 {
+		return []int{}
+	}
+
+	var candidates []trackGeometry
+	geometry := getGeometryCollection(db)
+	defer geometry.Database.Session.Close()
+	err := geometry.Find(bson.M{"$or": []bson.M{
+		{"cell_terms": bson.M{"$in": covering}},
+		{"cells": bson.M{"$in": ancestors}},
+	}}).Select(bson.M{"id": 1, "path": 1}).All(&candidates)
+	if err != nil {
+		panic(err)
+	}
+
+	ids := []int{}
+	for _, g := range candidates {
+		var path []s2.Point
+		for _, fix := range g.Path {
+			if (!from.IsZero() && fix.Time.Before(from)) || (!to.IsZero() && fix.Time.After(to)) {
+				continue
+			}
+			path = append(path, s2.PointFromLatLng(s2.LatLngFromDegrees(fix.Lat, fix.Lng)))
+		}
+		if len(path) > 0 && area.intersects(path) {
+			ids = append(ids, g.ID)
+		}
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+func parseLatLng(s string) (s2.LatLng, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 2 {
+		return s2.LatLng{}, fmt.Errorf("invalid coordinate '%v'", s)
+	}
+	lat, err := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	if err != nil || lat < -90 || lat > 90 {
+		return s2.LatLng{}, fmt.Errorf("invalid coordinate '%v'", s)
+	}
+	lng, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+	if err != nil || lng < -180 || lng > 180 {
+		return s2.LatLng{}, fmt.Errorf("invalid coordinate '%v'", s)
+	}
+	return s2.LatLngFromDegrees(lat, lng), nil
+}
+
+// parseArea reads the area of a spatial query of the given kind: a bbox
+// given as box=minLat,minLng,maxLat,maxLng, a radius in km around
+// center=lat,lng, or a polygon=lat,lng;lat,lng;... of at least three vertices
+func parseArea(c *gin.Context, kind string) (spatialArea, error) {
+	switch kind {
+	case "bbox":
+		box, err := parseRegion(c.Query("box"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid box")
+		}
+		rect := s2.RectFromLatLng(s2.LatLngFromDegrees(box[0], box[1])).
+			AddPoint(s2.LatLngFromDegrees(box[2], box[3]))
+		return boxArea{rect}, nil
+	case "radius":
+		center, err := parseLatLng(c.Query("center"))
+		if err != nil {
+			return nil, err
+		}
+		radius, err := strconv.ParseFloat(c.Query("radius"), 64)
+		if err != nil || radius <= 0 {
+			return nil, fmt.Errorf("invalid radius")
+		}
+		angle := s1.Angle(radius / igc.EarthRadius)
+		return radiusArea{s2.CapFromCenterAngle(s2.PointFromLatLng(center), angle)}, nil
+	case "polygon":
+		var vertices []s2.Point
+		for _, v := range strings.Split(c.Query("polygon"), ";") {
+			ll, err := parseLatLng(v)
+			if err != nil {
+				return nil, err
+			}
+			vertices = append(vertices, s2.PointFromLatLng(ll))
+		}
+		if len(vertices) < 3 {
+			return nil, fmt.Errorf("a polygon needs at least three vertices")
+		}
+		loop := s2.LoopFromPoints(vertices)
+		if err := loop.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid polygon: %v", err)
+		}
+		loop.Normalize()
+		return polygonArea{loop}, nil
+	default:
+		return nil, fmt.Errorf("unknown area '%v'", kind)
+	}
+}
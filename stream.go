@@ -0,0 +1,147 @@
+package main
+
+import (
+	"io"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-contrib/sse"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// Events kept for clients resuming the stream with Last-Event-ID
+	streamBacklog = 256
+	// Events buffered for a client before it is dropped as too slow
+	streamBuffer = 64
+	// Time between keep-alive comments on an idle stream
+	streamKeepAlive = 30 * time.Second
+)
+
+// trackEvent is a change to the stored tracks, sent to the stream
+type trackEvent struct {
+	ID    int64
+	Event string // created, updated or deleted
+	Track trackInfo
+}
+
+// eventBroker sends track events to the clients of the stream, keeping the
+// latest ones for clients resuming after a disconnection.
+//
+// Event ids are increasing milliseconds since the epoch, so that a client
+// resuming after a restart of the service receives the whole new backlog.
+type eventBroker struct {
+	mutex       sync.Mutex
+	lastID      int64
+	backlog     []trackEvent
+	subscribers map[chan trackEvent]bool
+}
+
+var events = &eventBroker{subscribers: make(map[chan trackEvent]bool)}
+
+// Publish sends an event for the track to every client
+func (b *eventBroker) Publish(event string, track trackInfo) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	id := time.Now().UnixNano() / int64(time.Millisecond)
+	if id <= b.lastID {
+		id = b.lastID + 1
+	}
+	b.lastID = id
+	e := trackEvent{ID: id, Event: event, Track: track}
+	b.backlog = append(b.backlog, e)
+	if len(b.backlog) > streamBacklog {
+		b.backlog = b.backlog[len(b.backlog)-streamBacklog:]
+	}
+	for ch := range b.subscribers {
+		select {
+		case ch <- e:
+		default:
+			// too slow, the client resumes from its last event when reconnecting
+			delete(b.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// Subscribe returns a channel of the new events, and the events of the
+// backlog after lastID
+func (b *eventBroker) Subscribe(lastID int64) (chan trackEvent, []trackEvent) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	var missed []trackEvent
+	for _, e := range b.backlog {
+		if e.ID > lastID {
+			missed = append(missed, e)
+		}
+	}
+	ch := make(chan trackEvent, streamBuffer)
+	b.subscribers[ch] = true
+	return ch, missed
+}
+
+// Unsubscribe stops sending events to the channel
+func (b *eventBroker) Unsubscribe(ch chan trackEvent) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.subscribers[ch] {
+		delete(b.subscribers, ch)
+		close(ch)
+	}
+}
+
+// publishTrack sends an event with the stored summary of a track, unless
+// it was deleted meanwhile
+func (db TrackDB) publishTrack(event string, id int) {
+	if t, ok := db.LookupTrack(id); ok {
+		events.Publish(event, t)
+	}
+}
+
+// streamEvents sends the track events to the client as Server-Sent Events,
+// starting after the Last-Event-ID header or lastEventId query parameter.
+// New clients, without either, only receive the events that follow.
+func streamEvents(c *gin.Context) {
+	lastID := c.GetHeader("Last-Event-ID")
+	if lastID == "" {
+		lastID = c.Query("lastEventId")
+	}
+	last := int64(math.MaxInt64)
+	if id, err := strconv.ParseInt(lastID, 10, 64); err == nil {
+		last = id
+	}
+
+	ch, missed := events.Subscribe(last)
+	defer events.Unsubscribe(ch)
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+
+	render := func(e trackEvent) {
+		c.Render(-1, sse.Event{Id: strconv.FormatInt(e.ID, 10), Event: e.Event, Data: e.Track})
+	}
+	for _, e := range missed {
+		render(e)
+	}
+	c.Writer.Flush()
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case e, ok := <-ch:
+			if !ok {
+				return false
+			}
+			render(e)
+		case <-keepAlive.C:
+			io.WriteString(w, ":\n\n")
+		case <-c.Request.Context().Done():
+			return false
+		}
+		return true
+	})
+}
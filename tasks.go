@@ -0,0 +1,309 @@
+package main
+
+import (
+	"math"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/golang/geo/s2"
+	"github.com/marni/goigc"
+)
+
+// storedTask is a competition task, that tracks are scored against
+type storedTask struct {
+	ID        int           `bson:"id" json:"id"`
+	Name      string        `bson:"name" json:"name"`
+	Created   time.Time     `bson:"created" json:"created"`
+	Task      xcTask        `bson:"task" json:"task"`
+	Distances taskDistances `bson:"-" json:"distances"`
+}
+
+func getTaskCollection(db TrackDB) *mgo.Collection {
+	return getNamedCollection(db, db.CollectionName+"Tasks")
+}
+
+// SaveTask stores a new task, returning its id
+func (db TrackDB) SaveTask(name string, task xcTask) int {
+	collection := getTaskCollection(db)
+	defer collection.Database.Session.Close()
+	var last storedTask
+	id := 0
+	err := collection.Find(nil).Sort("-id").One(&last)
+	if err == nil {
+		id = last.ID + 1
+	} else if err != mgo.ErrNotFound {
+		panic(err)
+	}
+	err = collection.Insert(storedTask{ID: id, Name: name, Created: time.Now(), Task: task})
+	if err != nil {
+		panic(err)
+	}
+	return id
+}
+
+// GetTasks returns every stored task
+func (db TrackDB) GetTasks() []storedTask {
+	tasks := []storedTask{}
+	collection := getTaskCollection(db)
+	defer collection.Database.Session.Close()
+	err := collection.Find(nil).Sort("id").All(&tasks)
+	if err != nil {
+		panic(err)
+	}
+	for i := range tasks {
+		tasks[i].Distances = tasks[i].Task.distances()
+	}
+	return tasks
+}
+
+// LookupTask returns a stored task by id
+func (db TrackDB) LookupTask(id int) (storedTask, bool) {
+	var t storedTask
+	tasks := getTaskCollection(db)
+	defer tasks.Database.Session.Close()
+	err := tasks.Find(bson.M{"id": id}).One(&t)
+	if err == mgo.ErrNotFound {
+		return t, false
+	}
+	if err != nil {
+		panic(err)
+	}
+	return t, true
+}
+
+func (tp xcTurnpoint) latLng() s2.LatLng {
+	return s2.LatLngFromDegrees(tp.Waypoint.Lat, tp.Waypoint.Lon)
+}
+
+// model returns the earth model of the task, WGS84 unless it asks for the
+// FAI sphere
+func (t xcTask) model() igc.EarthModel {
+	if t.EarthModel == "FAI_SPHERE" {
+		return igc.FAISphere
+	}
+	return igc.WGS84
+}
+
+// legs returns the distance between the centers of consecutive turnpoints
+// in km, from the first turnpoint after the takeoff
+func (t xcTask) legs() []float64 {
+	var legs []float64
+	m := t.model()
+	for i := t.first() + 1; i < len(t.Turnpoints); i++ {
+		legs = append(legs, m.Distance(t.Turnpoints[i-1].latLng(), t.Turnpoints[i].latLng()))
+	}
+	return legs
+}
+
+// first returns the index of the first turnpoint to reach, after the takeoff
+func (t xcTask) first() int {
+	if t.Turnpoints[0].Type == "TAKEOFF" {
+		return 1
+	}
+	return 0
+}
+
+// indexOf returns the index of the turnpoint of the given type, or def
+func (t xcTask) indexOf(kind string, def int) int {
+	for i, tp := range t.Turnpoints {
+		if tp.Type == kind {
+			return i
+		}
+	}
+	return def
+}
+
+// Distance returns the task distance in km, between the turnpoint centers,
+// on the earth model of the task
+func (t xcTask) Distance() float64 {
+	d := 0.0
+	for _, leg := range t.legs() {
+		d += leg
+	}
+	return d
+}
+
+// taskTurnpointResult is the time a turnpoint was reached
+type taskTurnpointResult struct {
+	Name    string     `json:"name"`
+	Type    string     `json:"type,omitempty"`
+	Reached *time.Time `json:"reached"`
+}
+
+// taskScore is the performance of a track on a task
+type taskScore struct {
+	Task       int                   `json:"task"`
+	Track      int                   `json:"track"`
+	Pilot      string                `json:"pilot"`
+	Turnpoints []taskTurnpointResult `json:"turnpoints"`
+	Start      *time.Time            `json:"start"` // start of the speed section
+	ESS        *time.Time            `json:"ess"`
+	Goal       bool                  `json:"goal"`
+	SpeedTime  float64               `json:"speed_time"` // seconds from start to ESS
+	Distance   float64               `json:"distance"`   // km flown along the task
+	TaskLength float64               `json:"task_distance"`
+}
+
+// inCylinder tells whether a position is inside the cylinder of a
+// turnpoint, widened by the tolerance of the task
+func (t xcTask) inCylinder(i int, ll s2.LatLng) bool {
+	tp := t.Turnpoints[i]
+	d := t.model().Distance(tp.latLng(), ll) * 1000
+	return d <= float64(tp.Radius)*(1+t.CylinderTolerance)
+}
+
+// beyondGoalLine tells whether a position is past the goal line, within
+// the radius of the goal across the last leg
+func (t xcTask) beyondGoalLine(ll s2.LatLng) bool {
+	n := len(t.Turnpoints)
+	goal, prev := t.Turnpoints[n-1].latLng(), t.Turnpoints[n-2].latLng()
+	m := t.model()
+	return t.inCylinder(n-1, ll) && angleDiff(m.Bearing(goal, ll), m.Bearing(prev, goal)) < 90
+}
+
+// ScoreTrack follows the track through the turnpoints of the task.
+//
+// Turnpoints are reached by entering their cylinder, the start by crossing
+// the SSS cylinder in its direction after the first time gate, the last
+// such crossing before the next turnpoint counting, and the goal by
+// entering its cylinder or crossing its line before the deadline. A race
+// starts at the last time gate before the crossing, an elapsed time task at
+// the crossing. The distance flown counts the legs completed and the
+// progress towards the next turnpoint.
+func (t xcTask) ScoreTrack(track igc.Track) taskScore {
+	n := len(t.Turnpoints)
+	first := t.first()
+	sss := t.indexOf("SSS", -1)
+	ess := t.indexOf("ESS", n-1)
+	legs := t.legs()
+
+	s := taskScore{Pilot: track.Pilot, TaskLength: t.Distance()}
+	for _, tp := range t.Turnpoints[first:] {
+		s.Turnpoints = append(s.Turnpoints, taskTurnpointResult{Name: tp.Waypoint.Name, Type: tp.Type})
+	}
+	if len(track.Points) == 0 {
+		return s
+	}
+
+	day := track.Points[0].Time.UTC().Truncate(24 * time.Hour)
+	var gates []time.Time
+	if t.SSS != nil {
+		for _, g := range t.SSS.TimeGates {
+			offset, _ := parseXCTime(g)
+			gates = append(gates, day.Add(offset))
+		}
+	}
+	var deadline time.Time
+	if t.Goal != nil && t.Goal.Deadline != "" {
+		offset, _ := parseXCTime(t.Goal.Deadline)
+		deadline = day.Add(offset)
+	}
+	line := t.Goal != nil && t.Goal.Type == "LINE"
+	exit := t.SSS == nil || t.SSS.Direction != "ENTER"
+
+	// reached tells whether the turnpoint i is reached at the fix j
+	points := track.Points
+	reached := func(i int, j int) bool {
+		ll := points[j].LatLng
+		switch {
+		case i == sss:
+			if len(gates) > 0 && points[j].Time.Before(gates[0]) || j == 0 {
+				return false
+			}
+			before, now := t.inCylinder(i, points[j-1].LatLng), t.inCylinder(i, ll)
+			if exit {
+				return before && !now
+			}
+			return !before && now
+		case i == n-1 && line:
+			return j > 0 && !t.beyondGoalLine(points[j-1].LatLng) && t.beyondGoalLine(ll)
+		default:
+			return t.inCylinder(i, ll)
+		}
+	}
+	setStart := func(at time.Time) {
+		start := at
+		if len(gates) > 0 && (t.SSS == nil || t.SSS.Type == "RACE") {
+			for _, g := range gates {
+				if !g.After(at) {
+					start = g
+				}
+			}
+		}
+		s.Start = &start
+	}
+
+	next := first
+	done, progress := 0.0, 0.0
+	for j, p := range points {
+		if !deadline.IsZero() && p.Time.After(deadline) {
+			break
+		}
+		tm := p.Time
+		if sss >= 0 && next == sss+1 && reached(sss, j) {
+			// restart
+			s.Turnpoints[sss-first].Reached = &tm
+			setStart(tm)
+		}
+		for next < n && reached(next, j) {
+			s.Turnpoints[next-first].Reached = &tm
+			if next == sss {
+				setStart(tm)
+			}
+			if next == ess {
+				s.ESS = &tm
+			}
+			if next > first {
+				done += legs[next-first-1]
+			}
+			next++
+			progress = 0
+		}
+		if next > first && next < n {
+			left := t.model().Distance(p.LatLng, t.Turnpoints[next].latLng())
+			progress = math.Max(progress, legs[next-first-1]-left)
+		}
+	}
+	s.Goal = next == n
+	s.Distance = done + progress
+	if s.Start != nil && s.ESS != nil {
+		s.SpeedTime = s.ESS.Sub(*s.Start).Seconds()
+	}
+	return s
+}
+
+// optimizedRoute returns the shortest route touching the cylinders of the
+// turnpoints, from the first one after the takeoff, a goal line being
+// reached at its center
+func (t xcTask) optimizedRoute() []s2.LatLng {
+	var cylinders []igc.Cylinder
+	for _, tp := range t.Turnpoints[t.first():] {
+		cylinders = append(cylinders, igc.Cylinder{Center: tp.latLng(), Radius: float64(tp.Radius) / 1000})
+	}
+	if t.Goal != nil && t.Goal.Type == "LINE" {
+		cylinders[len(cylinders)-1].Radius = 0
+	}
+	return t.model().OptimalRoute(cylinders)
+}
+
+// taskDistances are the distances of a task in km, between the turnpoint
+// centers and along the optimized route, on either earth model
+type taskDistances struct {
+	Sphere          float64 `json:"sphere"`
+	WGS84           float64 `json:"wgs84"`
+	OptimizedSphere float64 `json:"optimized_sphere"`
+	OptimizedWGS84  float64 `json:"optimized_wgs84"`
+}
+
+// distances returns the distances of the task on both earth models
+func (t xcTask) distances() taskDistances {
+	sphere, wgs84 := t, t
+	sphere.EarthModel, wgs84.EarthModel = "FAI_SPHERE", "WGS84"
+	return taskDistances{
+		Sphere:          sphere.Distance(),
+		WGS84:           wgs84.Distance(),
+		OptimizedSphere: igc.FAISphere.RouteDistance(sphere.optimizedRoute()),
+		OptimizedWGS84:  igc.WGS84.RouteDistance(wgs84.optimizedRoute()),
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/golang/geo/s2"
+	"github.com/marni/goigc"
+)
+
+const (
+	// Most SRTM tiles kept in memory, about 25 MB each at 1 arc second
+	terrainCacheTiles = 16
+	// Height above ground (m) under which a glider is taken as landed
+	groundClearance = 30.0
+	// Void samples of SRTM tiles
+	srtmVoid = -32768
+)
+
+// srtmTile is the grid of elevations of an SRTM .hgt tile, from its north
+// west corner by rows, samples wide and high
+type srtmTile struct {
+	samples int
+	data    []int16
+}
+
+// terrainModel reads terrain elevations from the SRTM .hgt tiles of a
+// directory, eg. N60E006.hgt, keeping the most recently used ones in memory
+type terrainModel struct {
+	dir   string
+	mutex sync.Mutex
+	tiles map[string]*srtmTile // nil for tiles missing from dir
+	used  []string             // loaded tiles, least recently used first
+}
+
+// Terrain elevations, from the tiles in DEM_DIR
+var terrain = newTerrainModel("")
+
+func newTerrainModel(dir string) *terrainModel {
+	return &terrainModel{dir: dir, tiles: make(map[string]*srtmTile)}
+}
+
+// tileName returns the name of the tile holding the given location
+func tileName(lat float64, lng float64) string {
+	ns, ew := 'N', 'E'
+	la, lo := int(math.Floor(lat)), int(math.Floor(lng))
+	if la < 0 {
+		ns, la = 'S', -la
+	}
+	if lo < 0 {
+		ew, lo = 'W', -lo
+	}
+	return fmt.Sprintf("%c%02d%c%03d.hgt", ns, la, ew, lo)
+}
+
+func readTile(path string) (*srtmTile, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	samples := int(math.Sqrt(float64(len(data) / 2)))
+	if samples < 2 || samples*samples*2 != len(data) {
+		return nil, fmt.Errorf("%v: not a square grid of samples", path)
+	}
+	tile := &srtmTile{samples: samples, data: make([]int16, samples*samples)}
+	for i := range tile.data {
+		tile.data[i] = int16(binary.BigEndian.Uint16(data[2*i:]))
+	}
+	return tile, nil
+}
+
+// tile returns the tile of the given name, loading it if needed, or nil if
+// there is no such tile
+func (m *terrainModel) tile(name string) *srtmTile {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if tile, ok := m.tiles[name]; ok {
+		if tile != nil {
+			for i := range m.used {
+				if m.used[i] == name {
+					m.used = append(append(m.used[:i:i], m.used[i+1:]...), name)
+					break
+				}
+			}
+		}
+		return tile
+	}
+	if m.dir == "" {
+		return nil
+	}
+
+	tile, err := readTile(filepath.Join(m.dir, name))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Println(err)
+		}
+		m.tiles[name] = nil
+		return nil
+	}
+	if len(m.used) == terrainCacheTiles {
+		delete(m.tiles, m.used[0])
+		m.used = m.used[1:]
+	}
+	m.tiles[name] = tile
+	m.used = append(m.used, name)
+	return tile
+}
+
+// Elevation returns the terrain elevation at a location in meters,
+// bilinearly interpolated between the samples around it, or false if its
+// tile is missing or all these samples are voids.
+func (m *terrainModel) Elevation(ll s2.LatLng) (float64, bool) {
+	lat, lng := ll.Lat.Degrees(), ll.Lng.Degrees()
+	tile := m.tile(tileName(lat, lng))
+	if tile == nil {
+		return 0, false
+	}
+	n := tile.samples - 1
+	y := (math.Floor(lat) + 1 - lat) * float64(n)
+	x := (lng - math.Floor(lng)) * float64(n)
+	row, col := int(math.Min(math.Floor(y), float64(n-1))), int(math.Min(math.Floor(x), float64(n-1)))
+	fy, fx := y-float64(row), x-float64(col)
+
+	var sum, weights float64
+	for _, s := range []struct {
+		row, col int
+		weight   float64
+	}{
+		{row, col, (1 - fy) * (1 - fx)},
+		{row, col + 1, (1 - fy) * fx},
+		{row + 1, col, fy * (1 - fx)},
+		{row + 1, col + 1, fy * fx},
+	} {
+		if v := tile.data[s.row*tile.samples+s.col]; v != srtmVoid {
+			sum += float64(v) * s.weight
+			weights += s.weight
+		}
+	}
+	if weights == 0 {
+		return 0, false
+	}
+	return sum / weights, true
+}
+
+// aboveGround returns the height of every fix above the terrain, NaN where
+// the elevation is unknown
+func (m *terrainModel) aboveGround(points []igc.Point) []float64 {
+	agl := make([]float64, len(points))
+	for i, p := range points {
+		agl[i] = math.NaN()
+		if elevation, ok := m.Elevation(p.LatLng); ok {
+			agl[i] = float64(altitude(p)) - elevation
+		}
+	}
+	return agl
+}
+
+// clearance holds the ground clearance statistics of a flight, over the
+// fixes with a known terrain elevation
+type clearance struct {
+	Min      float64   `bson:"min" json:"min"`
+	MinTime  time.Time `bson:"min_time" json:"min_time"`
+	Mean     float64   `bson:"mean" json:"mean"`
+	Max      float64   `bson:"max" json:"max"`
+	Coverage float64   `bson:"coverage" json:"coverage"`
+}
+
+// flightClearance returns the clearance statistics of the fixes between
+// takeoff and landing, or nil if the terrain is unknown under all of them
+func flightClearance(points []igc.Point, agl []float64, takeoff int, landing int) *clearance {
+	var c *clearance
+	var sum float64
+	known := 0
+	for i := takeoff; i <= landing && i < len(points); i++ {
+		if math.IsNaN(agl[i]) {
+			continue
+		}
+		if c == nil {
+			c = &clearance{Min: agl[i], MinTime: points[i].Time, Max: agl[i]}
+		}
+		if agl[i] < c.Min {
+			c.Min, c.MinTime = agl[i], points[i].Time
+		}
+		c.Max = math.Max(c.Max, agl[i])
+		sum += agl[i]
+		known++
+	}
+	if c != nil {
+		c.Mean = sum / float64(known)
+		c.Coverage = float64(known) / float64(landing-takeoff+1)
+	}
+	return c
+}
+
+// landOnGround moves the landing back to the first fix back on the ground
+// after the glider was last above groundClearance, so that eg. driving
+// back with the logger on is not counted as flight
+func landOnGround(agl []float64, takeoff int, landing int) int {
+	last := -1
+	for i := landing; i >= takeoff; i-- {
+		if agl[i] > groundClearance {
+			last = i
+			break
+		}
+	}
+	if last < 0 {
+		return landing
+	}
+	for i := last + 1; i <= landing; i++ {
+		if agl[i] <= groundClearance {
+			return i
+		}
+	}
+	return landing
+}
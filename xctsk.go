@@ -0,0 +1,358 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// Prefix of the XCTrack task QR codes
+const xctskQRPrefix = "XCTSK:"
+
+// xcWaypoint is a waypoint of an XCTrack task
+type xcWaypoint struct {
+	Name        string  `bson:"name" json:"name"`
+	Description string  `bson:"description" json:"description,omitempty"`
+	Lat         float64 `bson:"lat" json:"lat"`
+	Lon         float64 `bson:"lon" json:"lon"`
+	AltSmoothed int     `bson:"alt_smoothed" json:"altSmoothed"`
+}
+
+// xcTurnpoint is a cylinder of an XCTrack task. Type is TAKEOFF, SSS, ESS
+// or empty for a plain turnpoint. Tasks start at the TAKEOFF.
+type xcTurnpoint struct {
+	Type     string     `bson:"type,omitempty" json:"type,omitempty"`
+	Radius   int        `bson:"radius" json:"radius"` // m
+	Waypoint xcWaypoint `bson:"waypoint" json:"waypoint"`
+}
+
+// xcTakeoff is the window of the takeoff, times being HH:MM:SSZ in UTC
+type xcTakeoff struct {
+	TimeOpen  string `bson:"time_open,omitempty" json:"timeOpen,omitempty"`
+	TimeClose string `bson:"time_close,omitempty" json:"timeClose,omitempty"`
+}
+
+// xcStart is the start of the speed section: its type (RACE or
+// ELAPSED-TIME), the direction the SSS cylinder is crossed (ENTER or EXIT)
+// and the time gates
+type xcStart struct {
+	Type      string   `bson:"type" json:"type"`
+	Direction string   `bson:"direction" json:"direction"`
+	TimeGates []string `bson:"time_gates" json:"timeGates"`
+}
+
+// xcGoal is the goal of the task, a CYLINDER or a LINE of length twice the
+// radius of the last turnpoint, across the last leg
+type xcGoal struct {
+	Type     string `bson:"type" json:"type"`
+	Deadline string `bson:"deadline,omitempty" json:"deadline,omitempty"`
+}
+
+// xcTask is an XCTrack .xctsk task
+type xcTask struct {
+	TaskType          string        `bson:"task_type" json:"taskType"`
+	Version           int           `bson:"version" json:"version"`
+	EarthModel        string        `bson:"earth_model,omitempty" json:"earthModel,omitempty"`
+	Turnpoints        []xcTurnpoint `bson:"turnpoints" json:"turnpoints"`
+	Takeoff           *xcTakeoff    `bson:"takeoff,omitempty" json:"takeoff,omitempty"`
+	SSS               *xcStart      `bson:"sss,omitempty" json:"sss,omitempty"`
+	Goal              *xcGoal       `bson:"goal,omitempty" json:"goal,omitempty"`
+	CylinderTolerance float64       `bson:"cylinder_tolerance,omitempty" json:"cylinderTolerance,omitempty"`
+}
+
+// parseXCTime reads an HH:MM:SSZ time of day, as a duration from midnight UTC
+func parseXCTime(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04:05Z", strings.Trim(s, `"`))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time '%v'", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second, nil
+}
+
+// validate checks the task and fills in the defaults of XCTrack
+func (t *xcTask) validate() error {
+	if t.TaskType == "" {
+		t.TaskType = "CLASSIC"
+	}
+	if t.TaskType != "CLASSIC" {
+		return fmt.Errorf("unsupported task type '%v'", t.TaskType)
+	}
+	if t.Version == 0 {
+		t.Version = 1
+	}
+	if t.EarthModel == "" {
+		t.EarthModel = "WGS84"
+	}
+	if t.EarthModel != "WGS84" && t.EarthModel != "FAI_SPHERE" {
+		return fmt.Errorf("unsupported earth model '%v'", t.EarthModel)
+	}
+	if len(t.Turnpoints) < 2 {
+		return fmt.Errorf("a task needs at least 2 turnpoints")
+	}
+	if t.Turnpoints[0].Type != "TAKEOFF" {
+		// the QR codes have no type code for the takeoff, telling it by
+		// its place
+		return fmt.Errorf("the first turnpoint must be the takeoff")
+	}
+	sss, ess := -1, -1
+	for i, tp := range t.Turnpoints {
+		w := tp.Waypoint
+		if w.Lat < -90 || w.Lat > 90 || w.Lon < -180 || w.Lon > 180 {
+			return fmt.Errorf("turnpoint %v: invalid position", i)
+		}
+		if tp.Radius <= 0 {
+			return fmt.Errorf("turnpoint %v: invalid radius", i)
+		}
+		switch tp.Type {
+		case "":
+		case "TAKEOFF":
+			if i != 0 {
+				return fmt.Errorf("turnpoint %v: takeoff must be the first turnpoint", i)
+			}
+		case "SSS":
+			sss = i
+		case "ESS":
+			ess = i
+		default:
+			return fmt.Errorf("turnpoint %v: invalid type '%v'", i, tp.Type)
+		}
+	}
+	if sss >= 0 && ess >= 0 && ess < sss {
+		return fmt.Errorf("ESS before SSS")
+	}
+	if t.SSS != nil {
+		if t.SSS.Type == "" {
+			t.SSS.Type = "RACE"
+		}
+		if t.SSS.Type != "RACE" && t.SSS.Type != "ELAPSED-TIME" {
+			return fmt.Errorf("invalid sss type '%v'", t.SSS.Type)
+		}
+		if t.SSS.Direction == "" {
+			t.SSS.Direction = "EXIT"
+		}
+		if t.SSS.Direction != "ENTER" && t.SSS.Direction != "EXIT" {
+			return fmt.Errorf("invalid sss direction '%v'", t.SSS.Direction)
+		}
+		for _, gate := range t.SSS.TimeGates {
+			if _, err := parseXCTime(gate); err != nil {
+				return err
+			}
+		}
+	}
+	if t.Goal != nil {
+		if t.Goal.Type == "" {
+			t.Goal.Type = "CYLINDER"
+		}
+		if t.Goal.Type != "CYLINDER" && t.Goal.Type != "LINE" {
+			return fmt.Errorf("invalid goal type '%v'", t.Goal.Type)
+		}
+		if t.Goal.Deadline != "" {
+			if _, err := parseXCTime(t.Goal.Deadline); err != nil {
+				return err
+			}
+		}
+	}
+	if t.Takeoff != nil {
+		for _, s := range []string{t.Takeoff.TimeOpen, t.Takeoff.TimeClose} {
+			if s == "" {
+				continue
+			}
+			if _, err := parseXCTime(s); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// parseXCTask reads a task from the .xctsk JSON format, or from the
+// payload of an XCTrack QR code
+func parseXCTask(content []byte) (xcTask, error) {
+	var t xcTask
+	s := strings.TrimSpace(string(content))
+	if strings.HasPrefix(s, xctskQRPrefix) {
+		return parseXCTaskQR(s)
+	}
+	if err := json.Unmarshal([]byte(s), &t); err != nil {
+		return t, err
+	}
+	return t, t.validate()
+}
+
+// xcQRTurnpoint is a turnpoint of the QR payload, its position, altitude
+// and radius packed in z
+type xcQRTurnpoint struct {
+	Z           string `json:"z"`
+	Name        string `json:"n"`
+	Description string `json:"d,omitempty"`
+	Type        int    `json:"t,omitempty"` // 2 SSS, 3 ESS
+}
+
+type xcQRStart struct {
+	Gates     []string `json:"g"`
+	Direction int      `json:"d"` // 1 enter, 2 exit
+	Type      int      `json:"t"` // 1 race, 2 elapsed time
+}
+
+type xcQRGoal struct {
+	Deadline string `json:"d,omitempty"`
+	Type     int    `json:"t"` // 1 line, 2 cylinder
+}
+
+// xcQRTask is the compact task of the XCTrack QR codes, version 2
+type xcQRTask struct {
+	TaskType   string          `json:"taskType"`
+	Version    int             `json:"version"`
+	Turnpoints []xcQRTurnpoint `json:"t"`
+	TakeOpen   string          `json:"to,omitempty"`
+	TakeClose  string          `json:"tc,omitempty"`
+	EarthModel int             `json:"e"` // 0 WGS84, 1 FAI sphere
+	Start      *xcQRStart      `json:"s,omitempty"`
+	Goal       *xcQRGoal       `json:"g,omitempty"`
+}
+
+// appendPolyline appends the values to a Google encoded polyline
+func appendPolyline(b []byte, values ...int) []byte {
+	for _, v := range values {
+		u := uint(v) << 1
+		if v < 0 {
+			u = ^u
+		}
+		for u >= 0x20 {
+			b = append(b, byte(0x20|u&0x1F)+63)
+			u >>= 5
+		}
+		b = append(b, byte(u)+63)
+	}
+	return b
+}
+
+// decodePolyline returns the values of a Google encoded polyline
+func decodePolyline(s string) ([]int, error) {
+	var values []int
+	var u uint
+	var shift uint
+	for i := 0; i < len(s); i++ {
+		c := uint(s[i]) - 63
+		if c > 0x3F {
+			return nil, fmt.Errorf("invalid polyline")
+		}
+		u |= (c & 0x1F) << shift
+		shift += 5
+		if c&0x20 == 0 {
+			v := int(u >> 1)
+			if u&1 != 0 {
+				v = ^v
+			}
+			values = append(values, v)
+			u, shift = 0, 0
+		}
+	}
+	if shift != 0 {
+		return nil, fmt.Errorf("invalid polyline")
+	}
+	return values, nil
+}
+
+// qrPayload returns the task as the payload of an XCTrack QR code
+func (t xcTask) qrPayload() string {
+	q := xcQRTask{TaskType: t.TaskType, Version: 2}
+	if t.EarthModel == "FAI_SPHERE" {
+		q.EarthModel = 1
+	}
+	for _, tp := range t.Turnpoints {
+		w := tp.Waypoint
+		z := appendPolyline(nil, int(math.Round(w.Lon*1e5)), int(math.Round(w.Lat*1e5)), w.AltSmoothed, tp.Radius)
+		qt := xcQRTurnpoint{Z: string(z), Name: w.Name, Description: w.Description}
+		switch tp.Type {
+		case "SSS":
+			qt.Type = 2
+		case "ESS":
+			qt.Type = 3
+		}
+		q.Turnpoints = append(q.Turnpoints, qt)
+	}
+	if t.Takeoff != nil {
+		q.TakeOpen, q.TakeClose = t.Takeoff.TimeOpen, t.Takeoff.TimeClose
+	}
+	if t.SSS != nil {
+		q.Start = &xcQRStart{Gates: t.SSS.TimeGates, Direction: 2, Type: 1}
+		if t.SSS.Direction == "ENTER" {
+			q.Start.Direction = 1
+		}
+		if t.SSS.Type == "ELAPSED-TIME" {
+			q.Start.Type = 2
+		}
+	}
+	if t.Goal != nil {
+		q.Goal = &xcQRGoal{Deadline: t.Goal.Deadline, Type: 2}
+		if t.Goal.Type == "LINE" {
+			q.Goal.Type = 1
+		}
+	}
+	b, err := json.Marshal(q)
+	if err != nil {
+		panic(err)
+	}
+	return xctskQRPrefix + string(b)
+}
+
+// parseXCTaskQR reads a task from the payload of an XCTrack QR code
+func parseXCTaskQR(payload string) (xcTask, error) {
+	var q xcQRTask
+	var t xcTask
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(payload, xctskQRPrefix)), &q); err != nil {
+		return t, err
+	}
+	t.TaskType, t.Version = q.TaskType, 1
+	if q.EarthModel == 1 {
+		t.EarthModel = "FAI_SPHERE"
+	}
+	for i, qt := range q.Turnpoints {
+		z, err := decodePolyline(qt.Z)
+		if err != nil || len(z) != 4 {
+			return t, fmt.Errorf("turnpoint %v: invalid position", i)
+		}
+		tp := xcTurnpoint{
+			Radius: z[3],
+			Waypoint: xcWaypoint{
+				Name:        qt.Name,
+				Description: qt.Description,
+				Lon:         float64(z[0]) / 1e5,
+				Lat:         float64(z[1]) / 1e5,
+				AltSmoothed: z[2],
+			},
+		}
+		switch {
+		case qt.Type == 2:
+			tp.Type = "SSS"
+		case qt.Type == 3:
+			tp.Type = "ESS"
+		case i == 0:
+			// XCTrack tasks start at the takeoff, which has no type code
+			tp.Type = "TAKEOFF"
+		}
+		t.Turnpoints = append(t.Turnpoints, tp)
+	}
+	if q.TakeOpen != "" || q.TakeClose != "" {
+		t.Takeoff = &xcTakeoff{TimeOpen: q.TakeOpen, TimeClose: q.TakeClose}
+	}
+	if q.Start != nil {
+		t.SSS = &xcStart{Type: "RACE", Direction: "EXIT", TimeGates: q.Start.Gates}
+		if q.Start.Direction == 1 {
+			t.SSS.Direction = "ENTER"
+		}
+		if q.Start.Type == 2 {
+			t.SSS.Type = "ELAPSED-TIME"
+		}
+	}
+	if q.Goal != nil {
+		t.Goal = &xcGoal{Type: "CYLINDER", Deadline: q.Goal.Deadline}
+		if q.Goal.Type == 1 {
+			t.Goal.Type = "LINE"
+		}
+	}
+	return t, t.validate()
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPolyline(t *testing.T) {
+	values := []int{0, 1, -1, 15, -16, 16, -17, 1234567, -1234567, 5000000, -17998765}
+	s := string(appendPolyline(nil, values...))
+	got, err := decodePolyline(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, values) {
+		t.Errorf("got %v, want %v", got, values)
+	}
+
+	// the example of the polyline documentation
+	if s := string(appendPolyline(nil, -17998321)); s != "`~oia@" {
+		t.Errorf("got %q", s)
+	}
+
+	for _, s := range []string{"_", "`~oia", " "} {
+		if _, err := decodePolyline(s); err == nil {
+			t.Errorf("%q: no error", s)
+		}
+	}
+}
+
+// TestXCTaskQR sends a task south and west of the equator and the prime
+// meridian through a QR payload and back
+func TestXCTaskQR(t *testing.T) {
+	task := xcTask{
+		TaskType:   "CLASSIC",
+		Version:    1,
+		EarthModel: "FAI_SPHERE",
+		Turnpoints: []xcTurnpoint{
+			{Type: "TAKEOFF", Radius: 400, Waypoint: xcWaypoint{Name: "Lions Head", Lat: -33.93543, Lon: 18.38921, AltSmoothed: 669}},
+			{Type: "SSS", Radius: 3000, Waypoint: xcWaypoint{Name: "Signal Hill", Description: "start", Lat: -33.91702, Lon: 18.40003, AltSmoothed: 350}},
+			{Radius: 1000, Waypoint: xcWaypoint{Name: "West", Lat: -0.00001, Lon: -0.00001}},
+			{Type: "ESS", Radius: 2000, Waypoint: xcWaypoint{Name: "Ponta", Lat: -22.95107, Lon: -43.21049, AltSmoothed: -2}},
+			{Radius: 400, Waypoint: xcWaypoint{Name: "Goal", Lat: -22.9712, Lon: -179.99999, AltSmoothed: 4}},
+		},
+		Takeoff: &xcTakeoff{TimeOpen: "10:00:00Z", TimeClose: "12:00:00Z"},
+		SSS:     &xcStart{Type: "ELAPSED-TIME", Direction: "ENTER", TimeGates: []string{"12:00:00Z", "12:15:00Z"}},
+		Goal:    &xcGoal{Type: "LINE", Deadline: "17:00:00Z"},
+	}
+	if err := task.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	payload := task.qrPayload()
+	if !strings.HasPrefix(payload, xctskQRPrefix) {
+		t.Fatalf("got %q", payload)
+	}
+	got, err := parseXCTask([]byte(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, task) {
+		t.Errorf("got %+v, want %+v", got, task)
+	}
+	if again := got.qrPayload(); again != payload {
+		t.Errorf("got %q, want %q", again, payload)
+	}
+}
+
+func TestXCTaskTakeoff(t *testing.T) {
+	task := xcTask{
+		Turnpoints: []xcTurnpoint{
+			{Type: "SSS", Radius: 1000, Waypoint: xcWaypoint{Lat: 1, Lon: 1}},
+			{Radius: 1000, Waypoint: xcWaypoint{Lat: 2, Lon: 2}},
+		},
+	}
+	if err := task.validate(); err == nil {
+		t.Errorf("a task not starting at the takeoff is valid")
+	}
+	task.Turnpoints = append([]xcTurnpoint{{Type: "TAKEOFF", Radius: 400}}, task.Turnpoints...)
+	if err := task.validate(); err != nil {
+		t.Error(err)
+	}
+}